@@ -0,0 +1,306 @@
+// Package artifact stores the output files of targets by their content, so
+// that they can be restored instead of built again.
+package artifact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Store keeps files in a directory, each content once under objects/ and a
+// manifest, listing the files stored under a key, for each key under
+// manifests/.
+type Store struct {
+	dir string
+
+	// If not nil Remote is written to by Put and read from by Restore when
+	// something is not stored locally.
+	Remote Remote
+}
+
+// Remote is a store shared with other machines, such as a remote.Client.
+type Remote interface {
+	// Get copies the manifest or object named name to w, ok is false if
+	// there is none.
+	Get(kind, name string, w io.Writer) (ok bool, err error)
+	// Put stores what is read from r as the manifest or object named name.
+	Put(kind, name string, r io.Reader) error
+}
+
+// The kinds of entries of a Remote.
+const (
+	manifests = "manifests"
+	objects   = "objects"
+)
+
+type manifest struct {
+	Files []file `json:"files"`
+}
+
+type file struct {
+	Path   string      `json:"path"` // slash separated, relative to the root
+	Mode   os.FileMode `json:"mode"`
+	Object string      `json:"object"`
+}
+
+// Open opens the store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	for _, d := range []string{objects, manifests} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, errors.New("error opening artifact store: " + err.Error())
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put stores the files, given relative to root, under key, replacing what was
+// stored under it before. Directories are skipped.
+func (s *Store) Put(key, root string, files []string) error {
+	m := manifest{Files: []file{}}
+	for _, f := range files {
+		fi, err := os.Stat(filepath.Join(root, f))
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		obj, err := s.putObject(filepath.Join(root, f))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, file{filepath.ToSlash(f), fi.Mode().Perm(), obj})
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.manifest(key), data, 0600); err != nil {
+		return err
+	}
+	if s.Remote != nil {
+		return s.push(key, data, m)
+	}
+	return nil
+}
+
+// push writes the manifest data of key, and its objects, to the remote.
+func (s *Store) push(key string, data []byte, m manifest) error {
+	for _, f := range m.Files {
+		r, err := os.Open(s.object(f.Object))
+		if err != nil {
+			return err
+		}
+		err = s.Remote.Put(objects, f.Object, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// last, so that the objects are there for anyone reading the manifest
+	return s.Remote.Put(manifests, key, bytes.NewReader(data))
+}
+
+// Restore writes the files stored under key to their paths below root, ok is
+// false if nothing is stored under key.
+func (s *Store) Restore(key, root string) (ok bool, err error) {
+	data, err := ioutil.ReadFile(s.manifest(key))
+	remote := false
+	if os.IsNotExist(err) && s.Remote != nil {
+		buf := &bytes.Buffer{}
+		if remote, err = s.Remote.Get(manifests, key, buf); !remote || err != nil {
+			return false, err
+		}
+		data = buf.Bytes()
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, errors.New("bad artifact manifest " + key + ": " + err.Error())
+	}
+	// it may come from anyone who can write to the remote
+	for _, f := range m.Files {
+		if !validPath(f.Path) || !validObject(f.Object) {
+			return false, errors.New("bad artifact manifest " + key + ": bad file " + f.Path + " " + f.Object)
+		}
+	}
+	// get all objects first so that nothing is written for a manifest with
+	// objects removed from the store.
+	for _, f := range m.Files {
+		if _, err := os.Stat(s.object(f.Object)); !os.IsNotExist(err) {
+			continue
+		}
+		if s.Remote == nil {
+			return false, nil
+		}
+		if ok, err := s.pull(f.Object); !ok || err != nil {
+			return false, err
+		}
+	}
+	for _, f := range m.Files {
+		dst := filepath.Join(root, filepath.FromSlash(f.Path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return false, err
+		}
+		if err := copyFile(dst, s.object(f.Object), f.Mode); err != nil {
+			return false, err
+		}
+	}
+	if remote {
+		// kept so that it is found locally the next time
+		if err := writeFile(s.manifest(key), data, 0600); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// pull copies the object from the remote, checking that its content matches
+// its name.
+func (s *Store) pull(obj string) (ok bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(s.object(obj)), 0700); err != nil {
+		return false, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.object(obj)), ".tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	h := sha256.New()
+	ok, err = s.Remote.Get(objects, obj, io.MultiWriter(tmp, h))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if !ok || err != nil {
+		return false, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != obj {
+		return false, errors.New("bad artifact object " + obj + " from remote")
+	}
+	return true, os.Rename(tmp.Name(), s.object(obj))
+}
+
+// putObject copies the file at path into the store, returning the name of the
+// object.
+func (s *Store) putObject(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, objects), ".tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	obj := hex.EncodeToString(h.Sum(nil))
+	if _, err := os.Stat(s.object(obj)); err == nil {
+		return obj, nil // allready stored
+	}
+	if err := os.MkdirAll(filepath.Dir(s.object(obj)), 0700); err != nil {
+		return "", err
+	}
+	return obj, os.Rename(tmp.Name(), s.object(obj))
+}
+
+// validPath reports if the path of a file in a manifest is below the root.
+func validPath(p string) bool {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, "\\") || strings.HasPrefix(p[1:], ":") {
+		return false // or a windows path
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// validObject reports if obj is a sha256 in lower case hex, as objects are
+// named.
+func validObject(obj string) bool {
+	if len(obj) != 2*sha256.Size {
+		return false
+	}
+	for _, r := range obj {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Store) object(obj string) string {
+	return filepath.Join(s.dir, objects, obj[:2], obj)
+}
+
+func (s *Store) manifest(key string) string {
+	return filepath.Join(s.dir, manifests, key)
+}
+
+// copyFile replaces dst with a copy of src, so that a running program using
+// dst is not affected.
+func copyFile(dst, src string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".mbs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// writeFile writes data to path so that readers never see a partial file.
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
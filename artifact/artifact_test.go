@@ -0,0 +1,65 @@
+package artifact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := Open(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	write(t, filepath.Join(src, "bin", "a"), "aaa", 0755)
+	write(t, filepath.Join(src, "b"), "aaa", 0644)
+
+	if ok, err := s.Restore("k", src); ok || err != nil {
+		t.Fatal("expected nothing stored", ok, err)
+	}
+	if err := s.Put("k", src, []string{filepath.Join("bin", "a"), "b", "bin"}); err != nil {
+		t.Fatal(err)
+	}
+	if objs, _ := filepath.Glob(filepath.Join(dir, "store", "objects", "*", "*")); len(objs) != 1 {
+		t.Error("expected the same content to be stored once, got", objs)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	write(t, filepath.Join(dst, "b"), "old", 0644)
+	if ok, err := s.Restore("k", dst); !ok || err != nil {
+		t.Fatal("expected restored", ok, err)
+	}
+	for f, mode := range map[string]os.FileMode{"bin/a": 0755, "b": 0644} {
+		p := filepath.Join(dst, filepath.FromSlash(f))
+		data, err := ioutil.ReadFile(p)
+		if err != nil || string(data) != "aaa" {
+			t.Error("bad content of", f, string(data), err)
+		}
+		if fi, err := os.Stat(p); err != nil || fi.Mode().Perm() != mode {
+			t.Error("bad mode of", f, err)
+		}
+	}
+
+	// a missing object means nothing can be restored
+	objs, _ := filepath.Glob(filepath.Join(dir, "store", "objects", "*", "*"))
+	os.Remove(objs[0])
+	if ok, err := s.Restore("k", dst); ok || err != nil {
+		t.Error("expected nothing restored", ok, err)
+	}
+}
+
+func write(t *testing.T, path, data string, mode os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+}
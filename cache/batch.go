@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A Batch collects writes to a store so that they are all made at once by
+// Commit, and reads the store at once for Get and Duration. It may be used
+// from several goroutines.
+type Batch struct {
+	iterate   func(prefix string, fn func(e Entry) error) error
+	commit    func(values, durations map[string][]byte) error
+	mu        sync.Mutex
+	values    map[string][]byte
+	durations map[string][]byte
+	read      map[string]Entry // what was stored when first read, nil if not read
+
+	// fetch and push, if not nil, read and write the shared values
+	// elsewhere, see Shared
+	fetch   func(key string) ([]byte, bool)
+	push    func(values map[string][]byte)
+	shared  map[string]bool   // the keys staged by StageShared
+	fetched map[string][]byte // nil values if not found
+}
+
+func newBatch(iterate func(prefix string, fn func(e Entry) error) error, commit func(values, durations map[string][]byte) error) *Batch {
+	return &Batch{
+		iterate:   iterate,
+		commit:    commit,
+		values:    map[string][]byte{},
+		durations: map[string][]byte{},
+		shared:    map[string]bool{},
+	}
+}
+
+// Begin starts a new batch of writes to c, committed in one transaction.
+func (c *Cache) Begin() *Batch {
+	iterate := func(prefix string, fn func(e Entry) error) error {
+		err := c.Iterate(prefix, fn)
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		return err
+	}
+	return newBatch(iterate, func(values, durations map[string][]byte) error {
+		err := c.f.update(func(tx *bolt.Tx) error {
+			for _, w := range []struct {
+				bucket  []byte
+				records map[string][]byte
+			}{{bkt, values}, {durBkt, durations}} {
+				bk, err := c.bucket(tx, w.bucket)
+				if err != nil {
+					return err
+				}
+				for k, v := range w.records {
+					if err := bk.Put([]byte(k), stamp(v)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		return err
+	})
+}
+
+// Stage sets key to value when the batch is committed, replacing any value
+// staged earlier for key.
+func (b *Batch) Stage(key string, value []byte) {
+	if len(value) != ValueSize {
+		panic("value with bad length provided")
+	}
+	b.mu.Lock()
+	b.values[key] = append([]byte{}, value...)
+	b.mu.Unlock()
+}
+
+// StageShared stages value like Stage, and also writes it to where the
+// store shares its values, if it does, when the batch is committed.
+func (b *Batch) StageShared(key string, value []byte) {
+	b.Stage(key, value)
+	b.mu.Lock()
+	b.shared[key] = true
+	b.mu.Unlock()
+}
+
+// StageDuration records the duration of key when the batch is committed.
+func (b *Batch) StageDuration(key string, d time.Duration) {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(d))
+	b.mu.Lock()
+	b.durations[key] = v
+	b.mu.Unlock()
+}
+
+// Get returns the value staged for key or else the one stored, nil if there
+// is none. The store is read once, by the first Get or Duration, and not again
+// until Reload or Commit.
+func (b *Batch) Get(key string) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.values[key]; ok {
+		return append([]byte{}, v...)
+	}
+	return append([]byte(nil), b.load()[key].Value...)
+}
+
+// GetShared returns the value of key like Get, but reads what is not stored
+// from where the store shares its values, if it does, once for each key.
+func (b *Batch) GetShared(key string) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.values[key]; ok {
+		return append([]byte{}, v...)
+	}
+	if e, ok := b.load()[key]; ok || b.fetch == nil {
+		return append([]byte(nil), e.Value...)
+	}
+	return append([]byte(nil), b.fetchOnce(key)...)
+}
+
+// Duration returns the duration staged for key or else the one stored, see
+// Get.
+func (b *Batch) Duration(key string) (d time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v, ok := b.durations[key]; ok {
+		return time.Duration(binary.BigEndian.Uint64(v)), true
+	}
+	e, ok := b.load()["\x00"+key]
+	return e.Duration, ok
+}
+
+// fetchOnce calls fetch unless it allready did for key, what is fetched is
+// kept for the life of the batch.
+func (b *Batch) fetchOnce(key string) []byte {
+	if v, ok := b.fetched[key]; ok {
+		return v
+	}
+	if b.fetched == nil {
+		b.fetched = map[string][]byte{}
+	}
+	v, ok := b.fetch(key)
+	if !ok {
+		v = nil
+	}
+	b.fetched[key] = v
+	return v
+}
+
+// load reads the store unless allready read, keeping the durations under their
+// keys prefixed with a zero byte. An error reading is kept in the store and
+// reads as nothing stored.
+func (b *Batch) load() map[string]Entry {
+	if b.read != nil {
+		return b.read
+	}
+	b.read = map[string]Entry{}
+	b.iterate("", func(e Entry) error {
+		if e.Value == nil {
+			b.read["\x00"+e.Key] = e
+		} else {
+			b.read[e.Key] = e
+		}
+		return nil
+	})
+	return b.read
+}
+
+// Reload makes the next Get or Duration read the store again, to see what
+// others wrote to it since it was read.
+func (b *Batch) Reload() {
+	b.mu.Lock()
+	b.read = nil
+	b.mu.Unlock()
+}
+
+// Commit writes everything staged and empties the batch, so that it may be
+// used again. An error is also kept in the store, see Err. Of the values
+// staged by StageShared those that were not allready stored, or shared, are
+// then shared.
+func (b *Batch) Commit() error {
+	b.mu.Lock()
+	values, durations := b.values, b.durations
+	shared := map[string][]byte{}
+	if b.push != nil {
+		read := b.load()
+		for k := range b.shared {
+			if v := values[k]; !bytes.Equal(read[k].Value, v) && !bytes.Equal(b.fetched[k], v) {
+				shared[k] = v
+			}
+		}
+	}
+	b.values, b.durations, b.shared = map[string][]byte{}, map[string][]byte{}, map[string]bool{}
+	b.read = nil
+	b.mu.Unlock()
+	if len(values) == 0 && len(durations) == 0 {
+		return nil
+	}
+	if err := b.commit(values, durations); err != nil {
+		return err
+	}
+	if len(shared) > 0 {
+		b.push(shared)
+	}
+	return nil
+}
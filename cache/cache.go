@@ -2,29 +2,292 @@ package cache
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
 	"time"
 
-	"github.com/boltdb/bolt"
+	bolt "go.etcd.io/bbolt"
 )
 
-// TODO: implement deletion of old no longer useful values...
 // TODO: in order to delete files that no longer exist we must understand the globbing pattern used...
 
 const ValueSize = 28
 
+// DefaultProject is the project used by a cache until Project is called.
+const DefaultProject = "default"
+
+// Open opens the cache in the file at path, creating or migrating it if
+// needed. The file is only locked while it is read or written, so it may be
+// shared by several processes.
 func Open(path string) (*Cache, error) {
-	c := Cache{
-		path: path,
+	c := &Cache{
+		f:  &file{path: path},
+		ns: []byte(DefaultProject),
+	}
+	if err := c.f.update(func(*bolt.Tx) error { return nil }); err != nil {
+		return nil, err
 	}
-	return c.open()
+	return c, nil
 }
 
-var bkt = []byte("files")
+// lockTimeout is how long to wait for another process using the cache.
+var lockTimeout = 30 * time.Second
+
+var (
+	projectsBkt = []byte("projects")
+
+	// the buckets of each project
+	bkt     = []byte("files")
+	durBkt  = []byte("durations")
+	buckets = [][]byte{bkt, durBkt}
+
+	// recordSizes is the size of the records in each bucket, without the
+	// last used time stamp.
+	recordSizes = map[string]int{string(bkt): ValueSize, string(durBkt): 8}
+)
 
+// now is replaced in tests.
+var now = time.Now
+
+// Cache stores the values of one project, keeping them apart from those of
+// other projects in the same file.
 type Cache struct {
-	db   *bolt.DB
-	path string
-	err  error
+	f   *file
+	ns  []byte
+	err error
+}
+
+// file is shared by all projects opened from the same Cache.
+type file struct {
+	path  string
+	moved *CorruptError // set once the file was found corrupt and moved
+}
+
+// view runs fn in a read only transaction, holding a lock shared with other
+// readers. If there is no file fn is not run.
+func (f *file) view(fn func(*bolt.Tx) error) error {
+	if _, err := os.Stat(f.path); os.IsNotExist(err) {
+		return nil // removed by another process, so nothing is cached
+	}
+	return f.do(true, func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket(projectsBkt) == nil {
+				return nil // created but not yet initialized by another process
+			}
+			return fn(tx)
+		})
+	})
+}
+
+// update runs fn in a transaction holding the only lock on the file,
+// creating or migrating the file first if it is not of the current version,
+// as when it was removed or replaced since opened.
+func (f *file) update(fn func(*bolt.Tx) error) error {
+	return f.do(false, func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			if tx.Bucket(projectsBkt) == nil || version(tx) != schemaVersion {
+				if err := migrate(tx); err != nil {
+					return err
+				}
+			}
+			return fn(tx)
+		})
+	})
+}
+
+// do runs fn with the opened file. If the file turns out to be corrupt it is
+// moved aside and, unless only reading, fn is run again with a new file.
+func (f *file) do(readOnly bool, fn func(*bolt.DB) error) error {
+	seen, err := f.try(readOnly, fn)
+	if !corrupt(err) {
+		return err
+	}
+	if err := f.quarantine(seen, err); err != nil {
+		return err
+	}
+	if readOnly {
+		return nil // nothing is cached any more
+	}
+	_, err = f.try(readOnly, fn)
+	return err
+}
+
+// try runs fn with the opened file, bolt panics on some corrupt files which
+// is returned as a corruptError. seen is the file as found before opening it.
+// If the file is replaced, as when compacted by another process, while
+// waiting for its lock the new one is opened instead.
+func (f *file) try(readOnly bool, fn func(*bolt.DB) error) (seen os.FileInfo, err error) {
+	for {
+		seen, err = f.tryOnce(readOnly, fn)
+		if err != errReplaced {
+			return seen, err
+		}
+	}
+}
+
+// errReplaced is returned by open if the file opened is no longer the one at
+// its path once locked.
+var errReplaced = errors.New("cache file replaced while opening it")
+
+func (f *file) tryOnce(readOnly bool, fn func(*bolt.DB) error) (seen os.FileInfo, err error) {
+	seen, _ = os.Stat(f.path)
+	var db *bolt.DB
+	defer func() {
+		if r := recover(); r != nil {
+			err = corruptError{fmt.Sprint(r)}
+		}
+		if db != nil {
+			if cerr := db.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}()
+	if db, err = f.open(readOnly, seen); err != nil {
+		return seen, err
+	}
+	return seen, fn(db)
+}
+
+// quarantine moves the corrupt file, seen before it was opened, aside where
+// it is kept for inspection, and remembers that it did so for Err. It holds
+// the lock of the file while doing so, and leaves it if it is not seen as it
+// was replaced by another process that found it corrupt too.
+func (f *file) quarantine(seen os.FileInfo, cause error) error {
+	fd, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.New("error moving corrupt cache aside: " + err.Error())
+	}
+	defer fd.Close()
+	if err := lockFile(fd, lockTimeout); err == bolt.ErrTimeout {
+		return errLocked()
+	} else if err != nil {
+		return errors.New("error moving corrupt cache aside: " + err.Error())
+	}
+	locked, err := fd.Stat()
+	if err != nil {
+		return errors.New("error moving corrupt cache aside: " + err.Error())
+	}
+	if current, err := os.Stat(f.path); err != nil || seen == nil || !os.SameFile(seen, locked) || !os.SameFile(locked, current) {
+		return nil
+	}
+	moved := f.path + ".corrupt-" + now().Format("20060102-150405")
+	if err := os.Rename(f.path, moved); err != nil && !os.IsNotExist(err) {
+		return errors.New("error moving corrupt cache aside: " + err.Error())
+	}
+	f.moved = &CorruptError{Path: f.path, Moved: moved, Err: cause}
+	return nil
+}
+
+// CorruptError tells that the cache file could not be read and was replaced
+// by an empty one.
+type CorruptError struct {
+	Path  string
+	Moved string // where the corrupt file was moved
+	Err   error
+}
+
+func (e *CorruptError) Error() string {
+	return "cache " + e.Path + " was corrupt (" + e.Err.Error() + "), it was moved to " + e.Moved + " and everything is built again"
+}
+
+// corruptError is a panic of bolt while using the file.
+type corruptError struct {
+	msg string
+}
+
+func (e corruptError) Error() string {
+	return e.msg
+}
+
+// corrupt reports if err means that the file is not a usable bolt database.
+func corrupt(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case bolt.ErrInvalid, bolt.ErrVersionMismatch, bolt.ErrChecksum:
+		return true
+	}
+	_, ok := err.(corruptError)
+	return ok
+}
+
+// open opens and locks the file, seen before opening it. bolt fails with an error of
+// its own for a file shorter than its first pages, which is corrupt as bolt
+// never writes such a file.
+func (f *file) open(readOnly bool, seen os.FileInfo) (*bolt.DB, error) {
+	db, err := bolt.Open(f.path, 0600, &bolt.Options{Timeout: lockTimeout, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, errLocked()
+	}
+	if _, ok := err.(*os.PathError); err != nil && !ok && !corrupt(err) && seen != nil && seen.Size() > 0 && seen.Size() < minSize() {
+		return nil, corruptError{err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// what is written to a file replaced while waiting for its lock is lost
+	if current, err := os.Stat(f.path); err != nil || seen == nil || !os.SameFile(seen, current) {
+		db.Close()
+		return nil, errReplaced
+	}
+	return db, nil
+}
+
+// minSize is the size of the smallest file bolt writes, its two meta pages,
+// freelist and root page.
+func minSize() int64 {
+	return 4 * int64(os.Getpagesize())
+}
+
+func errLocked() error {
+	return errors.New("cache is locked by another process for more than " + lockTimeout.String())
+}
+
+// Project returns the cache of the named project in the same file.
+func (c *Cache) Project(name string) *Cache {
+	return &Cache{f: c.f, ns: []byte(name)}
+}
+
+// bucket returns the bucket name of the project, nil if it does not exist in
+// a read only transaction.
+func (c *Cache) bucket(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	p := tx.Bucket(projectsBkt).Bucket(c.ns)
+	if !tx.Writable() {
+		if p == nil {
+			return nil, nil
+		}
+		return p.Bucket(name), nil
+	}
+	var err error
+	if p == nil {
+		if p, err = tx.Bucket(projectsBkt).CreateBucket(c.ns); err != nil {
+			return nil, err
+		}
+	}
+	return p.CreateBucketIfNotExists(name)
+}
+
+// get returns the value of key in the bucket name, or nil if there is none or
+// it is damaged.
+func (c *Cache) get(name []byte, key string) (value []byte) {
+	err := c.f.view(func(tx *bolt.Tx) error {
+		b, err := c.bucket(tx, name)
+		if b != nil {
+			if v, _, ok := unstamp(b.Get([]byte(key)), recordSizes[string(name)]); ok {
+				value = append([]byte{}, v...)
+			}
+		}
+		return err
+	})
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return
 }
 
 // Set sets the key to value, returning false if the last call to Set for this
@@ -40,13 +303,15 @@ func (c *Cache) Set(key string, value []byte) (changed bool) {
 	k := []byte(key)
 	changed = true
 
-	err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bkt)
-		cv := b.Get(k)
-		if bytes.Equal(value, cv) {
+	err := c.f.update(func(tx *bolt.Tx) error {
+		b, err := c.bucket(tx, bkt)
+		if err != nil {
+			return err
+		}
+		if cv, _, ok := unstamp(b.Get(k), ValueSize); ok && bytes.Equal(value, cv) {
 			changed = false
 		}
-		return b.Put(k, value)
+		return b.Put(k, stamp(value))
 	})
 	if err != nil {
 		changed = true
@@ -57,25 +322,130 @@ func (c *Cache) Set(key string, value []byte) (changed bool) {
 	return
 }
 
-func (c *Cache) Err() error {
-	return c.err
+// Get returns the value last provided to Set for key, or nil if there is none.
+func (c *Cache) Get(key string) (value []byte) {
+	return c.get(bkt, key)
 }
-func (c *Cache) Close() error {
-	return c.db.Close()
+
+// SetDuration records how long it took to run the target identified by key.
+func (c *Cache) SetDuration(key string, d time.Duration) {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(d))
+	err := c.f.update(func(tx *bolt.Tx) error {
+		b, err := c.bucket(tx, durBkt)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), stamp(v))
+	})
+	if err != nil && c.err == nil {
+		c.err = err
+	}
 }
 
-func (c *Cache) open() (*Cache, error) {
-	db, err := bolt.Open(c.path, 0600, &bolt.Options{Timeout: 1 * time.Second})
-	if err != nil {
-		return nil, err
+// Duration returns the last duration recorded for key, ok is false if none is
+// recorded.
+func (c *Cache) Duration(key string) (d time.Duration, ok bool) {
+	if v := c.get(durBkt, key); v != nil {
+		return time.Duration(binary.BigEndian.Uint64(v)), true
 	}
-	// TODO: Check for file type version etc? (or in file name?)
-	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(bkt)
+	return 0, false
+}
+
+// Delete removes the values and durations of the keys.
+func (c *Cache) Delete(keys ...string) error {
+	return c.f.update(func(tx *bolt.Tx) error {
+		for _, bn := range buckets {
+			b, err := c.bucket(tx, bn)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := b.Delete([]byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Clear removes everything stored for the project.
+func (c *Cache) Clear() error {
+	return c.f.update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(projectsBkt).DeleteBucket(c.ns)
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
 		return err
-	}); err != nil {
-		return nil, err
+	})
+}
+
+// stampSize is what stamp adds to a value.
+const stampSize = 8 + 4
+
+// stamp returns the record for v, marked as used now and with a checksum so
+// that a damaged record is not mistaken for a value.
+func stamp(v []byte) []byte {
+	r := make([]byte, len(v)+stampSize)
+	copy(r, v)
+	binary.BigEndian.PutUint64(r[len(v):], uint64(now().UnixNano()))
+	binary.BigEndian.PutUint32(r[len(v)+8:], crc32.ChecksumIEEE(r[:len(v)+8]))
+	return r
+}
+
+// unstamp returns the value of the record r in a bucket with values of size
+// and when it was last used, ok is false if r is damaged.
+func unstamp(r []byte, size int) (v []byte, used time.Time, ok bool) {
+	if len(r) != size+stampSize || crc32.ChecksumIEEE(r[:size+8]) != binary.BigEndian.Uint32(r[size+8:]) {
+		return nil, time.Time{}, false
 	}
-	c.db = db
-	return c, nil
+	return r[:size], time.Unix(0, int64(binary.BigEndian.Uint64(r[size:]))), true
+}
+
+// Err returns the first error of a method without an error result or, if
+// there is none, a *CorruptError if the file was found corrupt and replaced.
+func (c *Cache) Err() error {
+	if c.err == nil && c.f.moved != nil {
+		return c.f.moved
+	}
+	return c.err
+}
+
+// Close does nothing as the file is only open during each transaction.
+func (c *Cache) Close() error {
+	return nil
+}
+
+// Iterate calls fn for all values and then all durations of the project with
+// keys starting with prefix, each in key order. The cache is locked while
+// iterating so fn may not write to it.
+func (c *Cache) Iterate(prefix string, fn func(e Entry) error) error {
+	p := []byte(prefix)
+	return c.f.view(func(tx *bolt.Tx) error {
+		for _, bn := range buckets {
+			b, _ := c.bucket(tx, bn)
+			if b == nil {
+				continue
+			}
+			size := recordSizes[string(bn)]
+			cur := b.Cursor()
+			for k, r := cur.Seek(p); k != nil && bytes.HasPrefix(k, p); k, r = cur.Next() {
+				v, used, ok := unstamp(r, size)
+				if !ok {
+					continue
+				}
+				e := Entry{Key: string(k), Used: used}
+				if bytes.Equal(bn, durBkt) {
+					e.Duration = time.Duration(binary.BigEndian.Uint64(v))
+				} else {
+					e.Value = append([]byte{}, v...)
+				}
+				if err := fn(e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 }
@@ -1,8 +1,21 @@
 package cache
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestSimple(t *testing.T) {
@@ -34,3 +47,631 @@ func v(s string) []byte {
 	}
 	return b
 }
+
+func TestDuration(t *testing.T) {
+	c, done := testCache(t)
+	defer done()
+
+	if _, ok := c.Duration("a"); ok {
+		t.Error("expected no duration")
+	}
+	c.SetDuration("a", 3*time.Second)
+	if d, ok := c.Duration("a"); !ok || d != 3*time.Second {
+		t.Error("expected 3s but got", d)
+	}
+	if c.Get("a") != nil {
+		t.Error("durations should not be visible as values")
+	}
+}
+
+func TestGC(t *testing.T) {
+	c, done := testCache(t)
+	defer done()
+	defer func() { now = time.Now }()
+
+	day := 24 * time.Hour
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) { now = func() time.Time { return start.Add(d) } }
+	at(0)
+	c.Set("old", v("a"))
+	c.SetDuration("old", time.Second)
+	at(10 * day)
+	c.Set("new", v("b"))
+	c.Set("gone", v("c"))
+
+	s, err := c.GC(GCOptions{
+		Before: start.Add(5 * day),
+		Keep:   func(key string) bool { return key != "gone" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Removed != 3 || s.Kept != 1 {
+		t.Error("expected 3 removed and 1 kept, got", s)
+	}
+	if c.Get("old") != nil || c.Get("gone") != nil {
+		t.Error("expected old and gone to be removed")
+	}
+	if _, ok := c.Duration("old"); ok {
+		t.Error("expected old duration to be removed")
+	}
+	if string(c.Get("new")) != string(v("b")) {
+		t.Error("expected new to be kept")
+	}
+	if c.Set("new", v("b")) {
+		t.Error("expected new to be unchanged")
+	}
+}
+
+func TestGCMaxSize(t *testing.T) {
+	c, done := testCache(t)
+	defer done()
+	defer func() { now = time.Now }()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		now = func() time.Time { return start.Add(time.Duration(i) * time.Hour) }
+		c.Set(strconv.Itoa(100+i), v("a"))
+	}
+	// each record is three bytes of key, the value, the time stamp and checksum
+	s, err := c.GC(GCOptions{MaxSize: 2 * 10 * (3 + ValueSize + stampSize + recordOverhead)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Kept != 10 {
+		t.Error("expected 10 kept, got", s)
+	}
+	if c.Get("100") != nil || c.Get("199") == nil {
+		t.Error("expected the least recently used to be removed")
+	}
+}
+
+func TestGCConcurrent(t *testing.T) {
+	// like two processes, each with its own handle on the file
+	gc, remove := testCache(t)
+	defer remove()
+	c, err := Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.Set(strconv.Itoa(i), v("a"))
+		}
+	}()
+	// each compacts the file, as a record is removed
+	for collected := false; !collected; {
+		select {
+		case <-done:
+			collected = true
+		default:
+		}
+		gc.Set("gone", v("b"))
+		if _, err := gc.GC(GCOptions{Keep: func(key string) bool { return key != "gone" }}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if c.Get(strconv.Itoa(i)) == nil {
+			t.Fatal("expected what is set while compacting to be kept, missing", i)
+		}
+	}
+}
+
+// testCache opens a new cache in ./test.test, the returned func closes and
+// removes it.
+func testCache(t *testing.T) (*Cache, func()) {
+	os.Remove("./test.test")
+	c, err := Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, func() {
+		c.Close()
+		os.Remove("./test.test")
+	}
+}
+
+// openAt creates a cache at path as written by f.
+func openAt(t *testing.T, path string, f func(tx *bolt.Tx) error) {
+	os.Remove(path)
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(f); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestMigrate(t *testing.T) {
+	defer os.Remove("./test.test")
+	openAt(t, "./test.test", func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucket(bkt)
+		b.Put([]byte("a"), v("a"))
+		b.Put([]byte("bad"), []byte("short"))
+		return nil
+	})
+	c, err := Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Get("a")) != string(v("a")) || c.Get("bad") != nil {
+		t.Error("expected a to be kept and bad to be removed")
+	}
+	s, err := c.GC(GCOptions{Before: time.Now().Add(-time.Hour)})
+	if err != nil || s.Kept != 1 {
+		t.Error("expected a to be marked as used when migrated", s, err)
+	}
+	c.Close()
+
+	c, err = Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Get("a")) != string(v("a")) {
+		t.Error("expected a current cache to be kept")
+	}
+	c.Close()
+
+	openAt(t, "./test.test", func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucket(metaBkt)
+		b.Put(versionKey, []byte{0, 0, 0, 0})
+		b, _ = tx.CreateBucket(bkt)
+		return b.Put([]byte("a"), v("a"))
+	})
+	c, err = Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Get("a") != nil {
+		t.Error("expected a cache without migration to be reset")
+	}
+	c.Close()
+
+	// version 3 keys are made relative to the directory of the makefile
+	// naming the project
+	root, _ := filepath.Abs("proj")
+	openAt(t, "./test.test", func(tx *bolt.Tx) error {
+		m, _ := tx.CreateBucket(metaBkt)
+		m.Put(versionKey, []byte{0, 0, 0, 3})
+		projects, _ := tx.CreateBucket(projectsBkt)
+		p, _ := projects.CreateBucket([]byte(filepath.Join(root, "Makefile.mbs")))
+		b, _ := p.CreateBucket(bkt)
+		b.Put([]byte(filepath.Join(root, "src", "*.go")), append(v("a"), 0, 0, 0, 0, 0, 0, 0, 1))
+		p, _ = projects.CreateBucket([]byte("named"))
+		b, _ = p.CreateBucket(bkt)
+		return b.Put([]byte(filepath.Join(root, "src", "*.go")), append(v("a"), 0, 0, 0, 0, 0, 0, 0, 1))
+	})
+	c, err = Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Project(root).Get("src/*.go")) != string(v("a")) {
+		t.Error("expected a version 3 key to be made relative")
+	}
+	n := 0
+	c.Project("named").Iterate("", func(Entry) error { n++; return nil })
+	if n != 0 {
+		t.Error("expected the absolute keys of a named project to be removed")
+	}
+	c.Close()
+
+	// version 4 records are kept, with a checksum added
+	openAt(t, "./test.test", func(tx *bolt.Tx) error {
+		m, _ := tx.CreateBucket(metaBkt)
+		m.Put(versionKey, []byte{0, 0, 0, 4})
+		p, _ := tx.CreateBucket(projectsBkt)
+		p, _ = p.CreateBucket([]byte(DefaultProject))
+		b, _ := p.CreateBucket(bkt)
+		return b.Put([]byte("a"), append(v("a"), 0, 0, 0, 0, 0, 0, 0, 1))
+	})
+	c, err = Open("./test.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Get("a")) != string(v("a")) {
+		t.Error("expected a version 4 cache to be migrated")
+	}
+
+	openAt(t, "./test.test", func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucket(metaBkt)
+		return b.Put(versionKey, []byte{0, 0, 0, 99})
+	})
+	_, err = Open("./test.test")
+	if verr, ok := err.(*VersionError); !ok || verr.Version != 99 {
+		t.Error("expected a version error, got", err)
+	}
+}
+
+func TestProject(t *testing.T) {
+	c, done := testCache(t)
+	defer done()
+
+	a, b := c.Project("a"), c.Project("b")
+	a.Set("x", v("a"))
+	a.Set("y", v("a"))
+	a.SetDuration("x", time.Second)
+	b.Set("x", v("b"))
+	if string(a.Get("x")) != string(v("a")) || string(b.Get("x")) != string(v("b")) || c.Get("x") != nil {
+		t.Error("expected projects to be kept apart")
+	}
+
+	if err := a.Delete("x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := a.Duration("x"); ok || a.Get("x") != nil || a.Get("y") == nil {
+		t.Error("expected only x to be deleted")
+	}
+	if _, err := a.GC(GCOptions{Keep: func(string) bool { return false }}); err != nil {
+		t.Fatal(err)
+	}
+	if a.Get("y") != nil || b.Get("x") == nil {
+		t.Error("expected only the project to be collected")
+	}
+	if err := b.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if b.Get("x") != nil {
+		t.Error("expected b to be cleared")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	os.Remove("./test.test")
+	defer os.Remove("./test.test")
+	done := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			// each opens the file on its own, as separate processes would
+			c, err := Open("./test.test")
+			if err != nil {
+				done <- err
+				return
+			}
+			defer c.Close()
+			for j := 0; j < 50; j++ {
+				k := strconv.Itoa(i) + strconv.Itoa(j)
+				c.Set(k, v(k))
+				if string(c.Get(k)) != string(v(k)) {
+					t.Error("expected", k, "to be set")
+				}
+			}
+			done <- c.Err()
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	c, done := testCache(t)
+	defer done()
+
+	b := c.Begin()
+	b.Stage("a", v("a"))
+	b.Stage("a", v("b"))
+	b.StageDuration("a", time.Second)
+	if c.Get("a") != nil {
+		t.Error("expected nothing to be written before commit")
+	}
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if string(c.Get("a")) != string(v("b")) {
+		t.Error("expected the last staged value")
+	}
+	if d, ok := c.Duration("a"); !ok || d != time.Second {
+		t.Error("expected 1s but got", d)
+	}
+	if c.Set("a", v("b")) {
+		t.Error("expected a to be unchanged")
+	}
+	if err := b.Commit(); err != nil {
+		t.Error("expected an empty commit to succeed", err)
+	}
+
+	// the store is read once until reloaded
+	b.Stage("b", v("b"))
+	if string(b.Get("a")) != string(v("b")) || string(b.Get("b")) != string(v("b")) {
+		t.Error("expected the stored and the staged values")
+	}
+	os.Remove("./test.test")
+	if d, ok := b.Duration("a"); !ok || d != time.Second || string(b.Get("a")) != string(v("b")) {
+		t.Error("expected the store to be read only once")
+	}
+	b.Reload()
+	if b.Get("a") != nil {
+		t.Error("expected the store to be read again")
+	}
+}
+
+func TestStores(t *testing.T) {
+	c, done := testCache(t)
+	defer done()
+
+	stores := map[string]Store{"bolt": c, "memory": NewMemory(), "shared": NewShared(NewMemory(), "p", &fakeRemote{})}
+	for name, s := range stores {
+		if !s.Set("b", v("b")) || s.Set("b", v("b")) || !s.Set("a", v("a")) {
+			t.Error(name, "unexpected changed from Set")
+		}
+		s.SetDuration("a", time.Second)
+		batch := s.Begin()
+		batch.Stage("c", v("c"))
+		batch.StageDuration("c", time.Minute)
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("b"); err != nil {
+			t.Fatal(err)
+		}
+		if string(s.Get("c")) != string(v("c")) || s.Get("b") != nil {
+			t.Error(name, "unexpected values")
+		}
+		if d, ok := s.Duration("c"); !ok || d != time.Minute {
+			t.Error(name, "unexpected duration", d)
+		}
+
+		got := ""
+		s.Iterate("", func(e Entry) error {
+			if e.Value != nil {
+				got += e.Key + string(e.Value[:1]) + " "
+			} else {
+				got += e.Key + e.Duration.String() + " "
+			}
+			return nil
+		})
+		if got != "aa cc a1s c1m0s " {
+			t.Error(name, "unexpected entries", got)
+		}
+		n := 0
+		s.Iterate("c", func(e Entry) error {
+			n++
+			return nil
+		})
+		if n != 2 {
+			t.Error(name, "expected 2 entries with prefix c, got", n)
+		}
+		if s.Err() != nil {
+			t.Error(name, s.Err())
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	from, to := NewMemory(), NewMemory()
+	from.Set("src/*.go", v("a"))
+	from.SetDuration("Makefile.mbs:all", time.Second)
+	from.Set("../lib/*.go", v("b"))
+
+	buf := &bytes.Buffer{}
+	if err := Export(from, buf); err != nil {
+		t.Fatal(err)
+	}
+	n, err := Import(to, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Error("expected 2 entries, got", n)
+	}
+	if string(to.Get("src/*.go")) != string(v("a")) || to.Get("../lib/*.go") != nil {
+		t.Error("expected the values inside the project to be imported")
+	}
+	if d, ok := to.Duration("Makefile.mbs:all"); !ok || d != time.Second {
+		t.Error("expected the duration to be imported")
+	}
+
+	if _, err := Import(to, strings.NewReader("not an archive")); err == nil {
+		t.Error("expected an error for a bad archive")
+	}
+	for _, key := range []string{"/etc/*.conf", "../lib/*.go", "src/../../x", `src\x`, "C:/x", ""} {
+		buf.Reset()
+		zw := gzip.NewWriter(buf)
+		json.NewEncoder(zw).Encode(export{Version: exportVersion, Entries: []exportEntry{{Key: key, Duration: 1}}})
+		zw.Close()
+		if _, err := Import(to, buf); err == nil {
+			t.Error("expected an error for the key", key)
+		}
+	}
+}
+
+// fakeRemote keeps its entries in memory, failing once err is set.
+type fakeRemote struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	gets    int
+	puts    int
+	err     error
+}
+
+func (r *fakeRemote) Get(kind, name string, w io.Writer) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gets++
+	if r.err != nil {
+		return false, r.err
+	}
+	e, ok := r.entries[kind+"/"+name]
+	w.Write(e)
+	return ok, nil
+}
+
+func (r *fakeRemote) Put(kind, name string, rd io.Reader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.puts++
+	if r.err != nil {
+		return r.err
+	}
+	if r.entries == nil {
+		r.entries = map[string][]byte{}
+	}
+	e, err := ioutil.ReadAll(rd)
+	r.entries[kind+"/"+name] = e
+	return err
+}
+
+func TestShared(t *testing.T) {
+	r := &fakeRemote{}
+	a, b := NewShared(NewMemory(), "p", r), NewShared(NewMemory(), "p", r)
+	defer a.Close()
+	defer b.Close()
+
+	batch := a.Begin()
+	batch.StageShared("x", v("x"))
+	batch.Stage("local", v("l"))
+	batch.StageDuration("x", time.Second)
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if r.puts != 1 {
+		t.Error("expected only the shared value to be pushed, got", r.puts)
+	}
+	batch.StageShared("x", v("x"))
+	batch.Commit()
+	if r.puts != 1 {
+		t.Error("expected an unchanged value not to be pushed again, got", r.puts)
+	}
+
+	// read from the remote once, and not stored locally
+	batch = b.Begin()
+	if string(batch.GetShared("x")) != string(v("x")) || batch.GetShared("local") != nil {
+		t.Error("expected the value of x from the remote only")
+	}
+	gets := r.gets
+	batch.GetShared("x")
+	batch.GetShared("local")
+	if r.gets != gets {
+		t.Error("expected the remote to be read once per key")
+	}
+	if batch.Get("x") != nil || b.Get("x") != nil {
+		t.Error("expected Get not to read the remote")
+	}
+	// a value found on the remote is not pushed back
+	batch.StageShared("x", v("x"))
+	batch.Commit()
+	if r.puts != 1 {
+		t.Error("expected a fetched value not to be pushed, got", r.puts)
+	}
+
+	// a local value is used over that of the remote
+	b.local.Set("x", v("z"))
+	if string(b.Begin().GetShared("x")) != string(v("z")) {
+		t.Error("expected the local value")
+	}
+
+	if NewShared(NewMemory(), "other", r).Begin().GetShared("x") != nil {
+		t.Error("expected the values of other projects not to be found")
+	}
+
+	// the remote is not used after failing
+	r.err = errors.New("unreachable")
+	c := NewShared(NewMemory(), "p", r)
+	defer c.Close()
+	batch = c.Begin()
+	if batch.GetShared("x") != nil || c.Err() != r.err {
+		t.Error("expected a miss and the error, got", c.Err())
+	}
+	gets, puts := r.gets, r.puts
+	batch.GetShared("y")
+	batch.StageShared("x", v("x"))
+	batch.Commit()
+	if r.gets != gets || r.puts != puts {
+		t.Error("expected the remote not to be used again")
+	}
+	if string(c.Get("x")) != string(v("x")) {
+		t.Error("expected the local store to still be used")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	os.RemoveAll("./corrupt")
+	os.Mkdir("./corrupt", 0700)
+	defer os.RemoveAll("./corrupt")
+	path := "./corrupt/test.test"
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("garbage "), 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(path)
+	if err != nil {
+		t.Fatal("expected a corrupt cache to be replaced, got", err)
+	}
+	cerr, ok := c.Err().(*CorruptError)
+	if !ok {
+		t.Fatal("expected a corrupt error, got", c.Err())
+	}
+	if data, _ := ioutil.ReadFile(cerr.Moved); !bytes.HasPrefix(data, []byte("garbage")) {
+		t.Error("expected the corrupt cache to be kept")
+	}
+	c.Set("a", v("a"))
+	if string(c.Get("a")) != string(v("a")) {
+		t.Error("expected the new cache to be used")
+	}
+
+	// a damaged record is a miss
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(projectsBkt).Bucket([]byte(DefaultProject)).Bucket(bkt)
+		r := append([]byte{}, b.Get([]byte("a"))...)
+		r[0]++
+		return b.Put([]byte("a"), r)
+	})
+	db.Close()
+	if c.Get("a") != nil {
+		t.Error("expected a damaged record to be a miss")
+	}
+	if !c.Set("a", v("a")) {
+		t.Error("expected a damaged record to differ from any value")
+	}
+
+	// too short for bolt to read its meta page, see open
+	short := "./corrupt/short.test"
+	ioutil.WriteFile(short, []byte("garbage"), 0600)
+	c, err = Open(short)
+	if err != nil {
+		t.Fatal("expected a short cache to be replaced, got", err)
+	}
+	if _, ok := c.Err().(*CorruptError); !ok {
+		t.Error("expected a corrupt error for a short file, got", c.Err())
+	}
+
+	// not moved if replaced by another process since found corrupt
+	ioutil.WriteFile(short, []byte("garbage"), 0600)
+	seen, _ := os.Stat(short)
+	os.Rename(short, short+".other")
+	if _, err := Open(short); err != nil {
+		t.Fatal(err)
+	}
+	f := &file{path: short}
+	if err := f.quarantine(seen, errors.New("corrupt")); err != nil || f.moved != nil {
+		t.Error("expected the new file to be left, got", err, f.moved)
+	}
+
+	// nor while another process has it open
+	seen, _ = os.Stat(short)
+	db, err = bolt.Open(short, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	defer func(d time.Duration) { lockTimeout = d }(lockTimeout)
+	lockTimeout = 100 * time.Millisecond
+	if err := f.quarantine(seen, errors.New("corrupt")); err == nil || f.moved != nil {
+		t.Error("expected to wait for the lock, got", err, f.moved)
+	}
+}
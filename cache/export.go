@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// exportVersion is the version of the export format, which is independent of
+// the schema of the cache file.
+const exportVersion = 1
+
+type export struct {
+	Version int           `json:"version"`
+	Entries []exportEntry `json:"entries"`
+}
+
+type exportEntry struct {
+	Key      string        `json:"key"` // slash separated and relative to the root
+	Hash     string        `json:"hash,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Export writes all entries of s to w as a gzipped JSON archive. Entries of
+// files outside the project are left out, as they are not the same files
+// where the archive is imported.
+func Export(s Store, w io.Writer) error {
+	ex := export{Version: exportVersion, Entries: []exportEntry{}}
+	err := s.Iterate("", func(e Entry) error {
+		if !portable(e.Key) {
+			return nil
+		}
+		ee := exportEntry{Key: e.Key, Duration: e.Duration}
+		if e.Value != nil {
+			ee.Hash = hex.EncodeToString(e.Value)
+		}
+		ex.Entries = append(ex.Entries, ee)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(ex); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Import reads an archive written by Export from r and stores its entries in
+// s. It returns the number of entries imported.
+func Import(s Store, r io.Reader) (n int, err error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, errors.New("error reading cache archive: " + err.Error())
+	}
+	ex := export{}
+	if err := json.NewDecoder(zr).Decode(&ex); err != nil {
+		return 0, errors.New("error reading cache archive: " + err.Error())
+	}
+	if ex.Version != exportVersion {
+		return 0, errors.New("unsupported cache archive version")
+	}
+
+	b := s.Begin()
+	for _, e := range ex.Entries {
+		if !portable(e.Key) {
+			return 0, errors.New("bad key in cache archive: " + e.Key)
+		}
+		if e.Hash == "" {
+			b.StageDuration(e.Key, e.Duration)
+			continue
+		}
+		v, err := hex.DecodeString(e.Hash)
+		if err != nil || len(v) != ValueSize {
+			return 0, errors.New("bad hash in cache archive for " + e.Key)
+		}
+		b.Stage(e.Key, v)
+	}
+	return len(ex.Entries), b.Commit()
+}
+
+// portable reports if key is relative to the root of the project and stays
+// inside it, so that it names the same files in any checkout.
+func portable(key string) bool {
+	if key == "" || path.IsAbs(key) || strings.Contains(key, "\\") || strings.HasPrefix(key[1:], ":/") {
+		return false // or a windows drive
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
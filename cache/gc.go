@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// recordOverhead is roughly what bolt needs for each record in addition to
+// the key and the value.
+const recordOverhead = 16
+
+// GCOptions selects the records removed by GC, from all projects unless
+// otherwise noted. Damaged records are always removed.
+type GCOptions struct {
+	// Before removes the records last used before it, unless it is zero.
+	Before time.Time
+	// Keep, if set, removes the records of the project of the cache for
+	// which it returns false.
+	Keep func(key string) bool
+	// MaxSize, if positive, removes the least recently used records until
+	// the remaining ones take at most half of it, so that the cache may grow
+	// for a while before it is collected again.
+	MaxSize int64
+}
+
+// GCStats tells what GC did.
+type GCStats struct {
+	Removed int
+	Kept    int
+	Size    int64 // of the cache file afterwards
+}
+
+type record struct {
+	project []byte
+	bucket  []byte
+	key     []byte
+	used    time.Time
+	size    int64
+}
+
+// GC removes the records selected by o and compacts the cache file if any
+// were removed.
+func (c *Cache) GC(o GCOptions) (s GCStats, err error) {
+	err = c.f.update(func(tx *bolt.Tx) error {
+		live := []record{}
+		remove := []record{}
+		projects := tx.Bucket(projectsBkt)
+		err := projects.ForEach(func(pn, _ []byte) error {
+			pn = append([]byte{}, pn...)
+			own := bytes.Equal(pn, c.ns)
+			for _, bn := range buckets {
+				b := projects.Bucket(pn).Bucket(bn)
+				if b == nil {
+					continue
+				}
+				size := recordSizes[string(bn)]
+				err := b.ForEach(func(k, v []byte) error {
+					k = append([]byte{}, k...) // deleted after the iteration
+					_, used, ok := unstamp(v, size)
+					r := record{pn, bn, k, used, int64(len(k) + len(v) + recordOverhead)}
+					if !ok || (!o.Before.IsZero() && r.used.Before(o.Before)) || (own && o.Keep != nil && !o.Keep(string(k))) {
+						remove = append(remove, r)
+					} else {
+						live = append(live, r)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if o.MaxSize > 0 {
+			total := int64(0)
+			for _, r := range live {
+				total += r.size
+			}
+			sort.SliceStable(live, func(i, j int) bool { return live[i].used.Before(live[j].used) })
+			n := 0
+			for ; n < len(live) && total > o.MaxSize/2; n++ {
+				total -= live[n].size
+			}
+			remove, live = append(remove, live[:n]...), live[n:]
+		}
+
+		for _, r := range remove {
+			if err := projects.Bucket(r.project).Bucket(r.bucket).Delete(r.key); err != nil {
+				return err
+			}
+		}
+		s.Removed, s.Kept = len(remove), len(live)
+		return nil
+	})
+	if err != nil {
+		return s, err
+	}
+	if s.Removed > 0 {
+		if err := c.compact(); err != nil {
+			return s, err
+		}
+	}
+	s.Size, err = c.Size()
+	return s, err
+}
+
+// Size returns the size of the cache file.
+func (c *Cache) Size() (int64, error) {
+	fi, err := os.Stat(c.f.path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// compact rewrites the cache file without the space left by removed records,
+// which bolt would otherwise keep. The file is replaced while it is locked,
+// processes waiting for the lock then open the new file, see file.open.
+func (c *Cache) compact() error {
+	tmp := c.f.path + ".compact"
+	os.Remove(tmp)
+	return c.f.update(func(tx *bolt.Tx) error {
+		db, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: lockTimeout})
+		if err != nil {
+			return err
+		}
+		err = db.Update(func(ntx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := ntx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, c.f.path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	})
+}
+
+// copyBucket copies everything in src, including nested buckets, to dst.
+func copyBucket(dst, src *bolt.Bucket) error {
+	dst.FillPercent = 1 // written in key order
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, src.Bucket(k))
+	})
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// lockFile waits up to timeout for the only lock on f, the one bolt holds
+// while writing, which is released when f is closed. It returns
+// bolt.ErrTimeout if it is not taken in time.
+func lockFile(f *os.File, timeout time.Duration) error {
+	start := time.Now()
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		if time.Since(start) > timeout {
+			return bolt.ErrTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/windows"
+)
+
+// lockFile waits up to timeout for the only lock on f, the one bolt holds
+// while writing, which is released when f is closed. It returns
+// bolt.ErrTimeout if it is not taken in time.
+func lockFile(f *os.File, timeout time.Duration) error {
+	start := time.Now()
+	for {
+		// bolt locks the byte at offset -1 rather than the file
+		m1 := ^uint32(0)
+		err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+			0, 1, 0, &windows.Overlapped{Offset: m1, OffsetHigh: m1})
+		if err != windows.ERROR_LOCK_VIOLATION {
+			return err
+		}
+		if time.Since(start) > timeout {
+			return bolt.ErrTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is a Store that keeps everything in memory, for tests and for
+// builds that need not remember anything.
+type Memory struct {
+	mu        sync.Mutex
+	values    map[string]memoryEntry
+	durations map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value []byte
+	d     time.Duration
+	used  time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		values:    map[string]memoryEntry{},
+		durations: map[string]memoryEntry{},
+	}
+}
+
+func (m *Memory) Get(key string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.values[key]; ok {
+		return append([]byte{}, e.value...)
+	}
+	return nil
+}
+
+func (m *Memory) Set(key string, value []byte) (changed bool) {
+	if len(value) != ValueSize {
+		panic("value with bad length provided")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed = !bytes.Equal(m.values[key].value, value)
+	m.values[key] = memoryEntry{value: append([]byte{}, value...), used: now()}
+	return
+}
+
+func (m *Memory) Duration(key string) (d time.Duration, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.durations[key]
+	return e.d, ok
+}
+
+func (m *Memory) SetDuration(key string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[key] = memoryEntry{d: d, used: now()}
+}
+
+func (m *Memory) Delete(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		delete(m.values, k)
+		delete(m.durations, k)
+	}
+	return nil
+}
+
+// Iterate calls fn for all values and then all durations with keys starting
+// with prefix, each in key order. The store may be written by fn.
+func (m *Memory) Iterate(prefix string, fn func(e Entry) error) error {
+	entries := []Entry{}
+	m.mu.Lock()
+	for _, records := range []map[string]memoryEntry{m.values, m.durations} {
+		start := len(entries)
+		for k, e := range records {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			entries = append(entries, Entry{Key: k, Value: e.value, Duration: e.d, Used: e.used})
+		}
+		own := entries[start:]
+		sort.Slice(own, func(i, j int) bool { return own[i].Key < own[j].Key })
+	}
+	m.mu.Unlock()
+	for _, e := range entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Begin() *Batch {
+	return newBatch(m.Iterate, func(values, durations map[string][]byte) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		t := now()
+		for k, v := range values {
+			m.values[k] = memoryEntry{value: v, used: t}
+		}
+		for k, v := range durations {
+			m.durations[k] = memoryEntry{d: time.Duration(binary.BigEndian.Uint64(v)), used: t}
+		}
+		return nil
+	})
+}
+
+// Err always returns nil as nothing can fail in memory.
+func (m *Memory) Err() error {
+	return nil
+}
@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersion is the version of the layout of the cache, it must be
+// increased, and a migration added if possible, whenever the layout or the
+// meaning of the keys or values change.
+//
+//	1: files and durations buckets, no meta bucket
+//	2: records carry the time they were last used
+//	3: the buckets of each project are kept in the projects bucket
+//	4: keys are relative to the root of the project
+//	5: records carry a checksum
+const schemaVersion = 5
+
+var (
+	metaBkt    = []byte("meta")
+	versionKey = []byte("version")
+)
+
+// migrations[v] migrates a cache from version v to v+1, a cache of a version
+// without a migration is reset.
+var migrations = map[int]func(tx *bolt.Tx) error{
+	1: stampRecords,
+	2: addProjects,
+	3: relativeKeys,
+	4: addChecksums,
+}
+
+// VersionError is returned when opening a cache written by a newer version of
+// mbs, it is left untouched so that it can still be used by that version.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("cache was written by a newer version of mbs (cache version %d, this mbs uses %d)", e.Version, schemaVersion)
+}
+
+// migrate brings the cache to the current version and makes sure all buckets
+// exist.
+func migrate(tx *bolt.Tx) error {
+	v := version(tx)
+	if v > schemaVersion {
+		return &VersionError{v}
+	}
+	for ; v < schemaVersion; v++ {
+		m := migrations[v]
+		if m == nil {
+			if err := reset(tx); err != nil {
+				return err
+			}
+			break
+		}
+		if err := m(tx); err != nil {
+			return fmt.Errorf("error migrating cache from version %d: %v", v, err)
+		}
+	}
+
+	for _, b := range [][]byte{projectsBkt, metaBkt} {
+		if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+			return err
+		}
+	}
+	if version(tx) == schemaVersion {
+		return nil
+	}
+	bv := make([]byte, 4)
+	binary.BigEndian.PutUint32(bv, schemaVersion)
+	return tx.Bucket(metaBkt).Put(versionKey, bv)
+}
+
+// version returns the version of the cache, 0 if it is not known.
+func version(tx *bolt.Tx) int {
+	meta := tx.Bucket(metaBkt)
+	if meta == nil {
+		if tx.Bucket(bkt) != nil {
+			return 1 // written before versions were recorded
+		}
+		return schemaVersion // new
+	}
+	if v := meta.Get(versionKey); len(v) == 4 {
+		return int(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+// stampRecords marks all records of version 1 as used now.
+func stampRecords(tx *bolt.Tx) error {
+	used := make([]byte, 8)
+	binary.BigEndian.PutUint64(used, uint64(now().UnixNano()))
+	for _, bn := range buckets {
+		b := tx.Bucket(bn)
+		if b == nil {
+			continue
+		}
+		size := recordSizes[string(bn)]
+		// the bucket may not be changed while iterating over it
+		keys, values := [][]byte{}, [][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			values = append(values, append([]byte{}, v...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, k := range keys {
+			if len(values[i]) != size {
+				err = b.Delete(k)
+			} else {
+				err = b.Put(k, append(values[i], used...))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addProjects moves the buckets of version 2 into the default project, which
+// is what a cache uses until a project is chosen.
+func addProjects(tx *bolt.Tx) error {
+	projects, err := tx.CreateBucketIfNotExists(projectsBkt)
+	if err != nil {
+		return err
+	}
+	p, err := projects.CreateBucketIfNotExists([]byte(DefaultProject))
+	if err != nil {
+		return err
+	}
+	for _, bn := range buckets {
+		b := tx.Bucket(bn)
+		if b == nil {
+			continue
+		}
+		to, err := p.CreateBucketIfNotExists(bn)
+		if err != nil {
+			return err
+		}
+		err = b.ForEach(func(k, v []byte) error {
+			return to.Put(append([]byte{}, k...), append([]byte{}, v...))
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket(bn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relativeKeys makes the absolute keys of version 3 relative to the root of
+// their project. A project was then named by the path of its makefile, so its
+// directory is the root and, as the project is not marked, the new name.
+// Absolute keys of projects named otherwise can not be converted and are
+// removed.
+func relativeKeys(tx *bolt.Tx) error {
+	projects := tx.Bucket(projectsBkt)
+	if projects == nil {
+		return nil
+	}
+	// read everything first as the buckets are renamed
+	type project struct {
+		root    string
+		records map[string]map[string][]byte // by bucket and key
+	}
+	old := map[string]project{}
+	err := projects.ForEach(func(name, _ []byte) error {
+		p := project{records: map[string]map[string][]byte{}}
+		if filepath.IsAbs(string(name)) {
+			p.root = filepath.Dir(string(name))
+		}
+		for _, bn := range buckets {
+			p.records[string(bn)] = map[string][]byte{}
+			b := projects.Bucket(name).Bucket(bn)
+			if b == nil {
+				continue
+			}
+			b.ForEach(func(k, v []byte) error {
+				p.records[string(bn)][string(k)] = append([]byte{}, v...)
+				return nil
+			})
+		}
+		old[string(name)] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name := range old {
+		if err := projects.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+	}
+	for name, p := range old {
+		if p.root != "" {
+			name = p.root
+		}
+		pb, err := projects.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		for bn, records := range p.records {
+			b, err := pb.CreateBucketIfNotExists([]byte(bn))
+			if err != nil {
+				return err
+			}
+			for k, v := range records {
+				if filepath.IsAbs(k) {
+					rel, err := filepath.Rel(p.root, k)
+					if p.root == "" || err != nil {
+						continue
+					}
+					k = filepath.ToSlash(rel)
+				}
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addChecksums adds a checksum to all records of version 4, keeping when they
+// were last used.
+func addChecksums(tx *bolt.Tx) error {
+	projects := tx.Bucket(projectsBkt)
+	if projects == nil {
+		return nil
+	}
+	names := [][]byte{}
+	projects.ForEach(func(name, _ []byte) error {
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	for _, pn := range names {
+		for _, bn := range buckets {
+			b := projects.Bucket(pn).Bucket(bn)
+			if b == nil {
+				continue
+			}
+			size := recordSizes[string(bn)]
+			records := map[string][]byte{}
+			b.ForEach(func(k, v []byte) error {
+				records[string(k)] = append([]byte{}, v...)
+				return nil
+			})
+			for k, v := range records {
+				if len(v) != size+8 {
+					if err := b.Delete([]byte(k)); err != nil {
+						return err
+					}
+					continue
+				}
+				r := append(v, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(r[size+8:], crc32.ChecksumIEEE(v))
+				if err := b.Put([]byte(k), r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reset removes everything in the cache.
+func reset(tx *bolt.Tx) error {
+	names := [][]byte{}
+	err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		names = append(names, append([]byte{}, name...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := tx.DeleteBucket(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// Remote is a store shared with other machines, such as a remote.Client.
+type Remote interface {
+	// Get copies the entry of kind named name to w, ok is false if there is
+	// none.
+	Get(kind, name string, w io.Writer) (ok bool, err error)
+	// Put stores what is read from r as the entry of kind named name.
+	Put(kind, name string, r io.Reader) error
+}
+
+// records is the kind of the entries of a Remote used by Shared.
+const records = "records"
+
+// pushers is how many values Shared writes to the remote at once.
+const pushers = 8
+
+// Shared is a Store that shares some of the values of the store local with
+// other machines through a remote, so that a build on one machine finds the
+// values recorded by builds on others. Only the values staged by
+// Batch.StageShared are written to the remote, and only Batch.GetShared reads
+// it, everything else is local. Values are only found if the keys and values
+// are the same on all machines, i.e. if the project is named the same and
+// content is hashed.
+//
+// After the first error of the remote it is not used again, the error is
+// returned by Err unless the local store has one.
+type Shared struct {
+	local   Store
+	project string
+	remote  Remote
+
+	mu  sync.Mutex
+	err error
+
+	start sync.Once
+	queue chan upload // to the pushers
+}
+
+// upload is a value to write to the remote, done when written or failed.
+type upload struct {
+	name  string
+	value []byte
+	done  *sync.WaitGroup
+}
+
+// NewShared returns a store of the project named project that keeps its
+// values in local and shares them through remote.
+func NewShared(local Store, project string, remote Remote) *Shared {
+	return &Shared{local: local, project: project, remote: remote}
+}
+
+func (s *Shared) Get(key string) []byte {
+	return s.local.Get(key)
+}
+
+func (s *Shared) Set(key string, value []byte) (changed bool) {
+	return s.local.Set(key, value)
+}
+
+func (s *Shared) Duration(key string) (d time.Duration, ok bool) {
+	return s.local.Duration(key)
+}
+
+func (s *Shared) SetDuration(key string, d time.Duration) {
+	s.local.SetDuration(key, d)
+}
+
+// Delete removes the keys from the local store only, so that what the remote
+// has for them is found again by GetShared.
+func (s *Shared) Delete(keys ...string) error {
+	return s.local.Delete(keys...)
+}
+
+func (s *Shared) Iterate(prefix string, fn func(e Entry) error) error {
+	return s.local.Iterate(prefix, fn)
+}
+
+// Begin starts a batch of writes to the local store, that shares the values
+// staged by StageShared when committed.
+func (s *Shared) Begin() *Batch {
+	b := s.local.Begin()
+	b.fetch = s.fetch
+	b.push = s.push
+	return b
+}
+
+func (s *Shared) Err() error {
+	if err := s.local.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops the goroutines writing to the remote, the store must not be
+// committed to after. The local store is not closed.
+func (s *Shared) Close() error {
+	s.start.Do(func() {})
+	if s.queue != nil {
+		close(s.queue)
+	}
+	return nil
+}
+
+// fetch reads the value of key from the remote. A value of the wrong size is
+// taken as missing.
+func (s *Shared) fetch(key string) ([]byte, bool) {
+	if s.failed() {
+		return nil, false
+	}
+	buf := bytes.NewBuffer(nil)
+	ok, err := s.remote.Get(records, s.name(key), buf)
+	if err != nil {
+		s.fail(err)
+		return nil, false
+	}
+	if !ok || buf.Len() != ValueSize {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// push writes the values to the remote, returning once all are written.
+func (s *Shared) push(values map[string][]byte) {
+	s.start.Do(func() {
+		s.queue = make(chan upload)
+		for i := 0; i < pushers; i++ {
+			go s.pusher()
+		}
+	})
+	done := &sync.WaitGroup{}
+	done.Add(len(values))
+	for k, v := range values {
+		s.queue <- upload{s.name(k), v, done}
+	}
+	done.Wait()
+}
+
+func (s *Shared) pusher() {
+	for u := range s.queue {
+		if !s.failed() {
+			if err := s.remote.Put(records, u.name, bytes.NewReader(u.value)); err != nil {
+				s.fail(err)
+			}
+		}
+		u.done.Done()
+	}
+}
+
+// name returns the name of the value of key on the remote, which keeps the
+// values of all projects together.
+func (s *Shared) name(key string) string {
+	h := sha256.Sum256([]byte("value\x00" + s.project + "\x00" + key))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *Shared) failed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil
+}
+
+func (s *Shared) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
@@ -0,0 +1,35 @@
+package cache
+
+import "time"
+
+// Store keeps the values and durations of a project. Errors reading or
+// writing are kept and returned by Err, and otherwise behave as if nothing
+// was stored.
+type Store interface {
+	// Get returns the value last set for key, or nil if there is none.
+	Get(key string) []byte
+	// Set sets key to value, changed is false if value was allready set.
+	Set(key string, value []byte) (changed bool)
+	// Duration returns the duration recorded for key, if any.
+	Duration(key string) (d time.Duration, ok bool)
+	// SetDuration records how long it took to run the target of key.
+	SetDuration(key string, d time.Duration)
+	// Delete removes the values and durations of the keys.
+	Delete(keys ...string) error
+	// Iterate calls fn for all values and then all durations with keys
+	// starting with prefix, each in key order, stopping at the first error
+	// which is returned.
+	Iterate(prefix string, fn func(e Entry) error) error
+	// Begin starts a batch of writes made at once when committed, that also
+	// reads the store at once.
+	Begin() *Batch
+	Err() error
+}
+
+// An Entry is a value or a duration in a store.
+type Entry struct {
+	Key      string
+	Value    []byte // nil for a duration
+	Duration time.Duration
+	Used     time.Time // when it was last set
+}
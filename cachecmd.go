@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/vron/mbs/cache"
+	"github.com/vron/mbs/mbs"
+	"github.com/vron/mbs/remote"
+)
+
+const cacheUsage = `usage: mbs [flags] cache <command>
+
+commands:
+  ls [prefix]    list the entries of the project, optionally only those with keys starting with prefix
+  show <key>     show everything stored for key and the files its glob matches now
+  rm <key>...    remove the entries of the keys
+  stats          show the number of entries of the project and the size of the cache
+  export <file>  write the entries of the project to file
+  import <file>  add the entries in file, written by export, to the project
+
+An exported cache is only useful in another checkout if both use -hash-content.
+A target named cache is built by 'mbs [flags] -- cache'.`
+
+const cacheServerUsage = `usage: mbs cache-server [-addr host:port] dir
+
+Serves the artifact store in dir, creating it if needed, to builds run with
+-remote-cache http://host:port. The builds share the declared outputs of
+targets, and the hashes of the globs of targets with declared outputs so that
+such a target built by one is clean for the others, with its outputs
+restored. Targets without declared outputs are run by each build. Hashes only
+match if the builds use -hash-content and the project is named by a root
+marker, see -project. Clearing the cache of a build does not clear what the
+server has, build without -remote-cache to run everything.
+
+flags:`
+
+// doCacheServer serves a remote artifact store until it fails.
+func doCacheServer(args []string) {
+	fs := flag.NewFlagSet("cache-server", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "the address to listen on")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, cacheServerUsage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	s, err := remote.NewServer(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("serving %s on %s\n", fs.Arg(0), *addr)
+	fmt.Fprintln(os.Stderr, http.ListenAndServe(*addr, s))
+}
+
+// doCache runs the cache command in args on the cache of the project.
+func doCache(b *mbs.Builder, c *cache.Cache, makefile string, args []string) {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	var err error
+	switch cmd, n := args[0], len(args)-1; {
+	case cmd == "ls" && n <= 1:
+		err = cacheLs(c, strings.Join(args[1:], ""))
+	case cmd == "show" && n == 1:
+		err = cacheShow(b, c, makefile, args[1])
+	case cmd == "rm" && n >= 1:
+		err = c.Delete(args[1:]...)
+	case cmd == "stats" && n == 0:
+		err = cacheStats(c)
+	case cmd == "export" && n == 1:
+		err = cacheExport(c, args[1])
+	case cmd == "import" && n == 1:
+		err = cacheImport(c, args[1])
+	default:
+		fmt.Fprintln(os.Stderr, cacheUsage)
+		os.Exit(1)
+	}
+	if err == nil {
+		err = c.Err()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func cacheLs(c *cache.Cache, prefix string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	err := c.Iterate(prefix, func(e cache.Entry) error {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Key, describe(e), formatUsed(e.Used))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func cacheShow(b *mbs.Builder, c *cache.Cache, makefile, key string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	found := false
+	err := c.Iterate(key, func(e cache.Entry) error {
+		if e.Key != key {
+			return nil
+		}
+		if !found {
+			fmt.Fprintf(w, "key:\t%s\n", e.Key)
+			found = true
+		}
+		if e.Value != nil {
+			fmt.Fprintf(w, "hash:\t%s\n", hex.EncodeToString(e.Value))
+			fmt.Fprintf(w, "recorded:\t%s\n", formatUsed(e.Used))
+		} else {
+			fmt.Fprintf(w, "duration:\t%v\n", e.Duration)
+			fmt.Fprintf(w, "duration recorded:\t%s\n", formatUsed(e.Used))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no entry for %s in the cache", key)
+	}
+	// the makefile may be gone, then only what is stored is shown
+	if keys, err := b.CacheKeys(makefile); err == nil {
+		fmt.Fprintf(w, "targets:\t%s\n", strings.Join(keys[key], ", "))
+	}
+	if files, err := b.KeyFiles(makefile, key); err == nil && files != nil {
+		fmt.Fprintf(w, "files:\t%d\n", len(files))
+		for _, f := range files {
+			fmt.Fprintf(w, "\t%s\n", relPath(f))
+		}
+	}
+	return w.Flush()
+}
+
+func cacheStats(c *cache.Cache) error {
+	hashes, durations := 0, 0
+	oldest := cache.Entry{}
+	err := c.Iterate("", func(e cache.Entry) error {
+		if e.Value != nil {
+			hashes++
+		} else {
+			durations++
+		}
+		if oldest.Key == "" || e.Used.Before(oldest.Used) {
+			oldest = e
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	size, err := c.Size()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "project:\t%s\n", projectName())
+	fmt.Fprintf(w, "entries:\t%d (%d hashes, %d durations)\n", hashes+durations, hashes, durations)
+	fmt.Fprintf(w, "size:\t%d kB, of all projects\n", size>>10)
+	if oldest.Key != "" {
+		fmt.Fprintf(w, "oldest:\t%s %s\n", formatUsed(oldest.Used), oldest.Key)
+	}
+	return w.Flush()
+}
+
+func cacheExport(c *cache.Cache, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = cache.Export(c, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func cacheImport(c *cache.Cache, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := cache.Import(c, f)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d entries\n", n)
+	return nil
+}
+
+func describe(e cache.Entry) string {
+	if e.Value != nil {
+		return "hash " + hex.EncodeToString(e.Value)[:12]
+	}
+	return "duration " + e.Duration.Round(time.Millisecond).String()
+}
+
+func formatUsed(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
@@ -14,16 +14,39 @@ type Makefile struct {
 }
 
 type Import struct {
-	Pos  Pos
-	Path string
-	Name string
+	Pos    Pos
+	Path   string
+	Name   string
+	Doc    string // comment lines directly above the import
+	DocPos Pos
 }
 
 type Target struct {
+	Pos     Pos
+	Name    string
+	Deps    []Dependency
+	Cmds    []Command
+	Service bool   // if true the last command keeps running in the background
+	Ready   *Ready // how to know that a service is up, nil if started is enough
+	Outputs []Output
+	Doc     string // comment lines directly above the target
+	DocPos  Pos
+}
+
+// Ready is declared by a line "@ready tcp host:port" or "@ready command" in
+// a service.
+type Ready struct {
 	Pos  Pos
-	Name string
-	Deps []Dependency
-	Cmds []Command
+	Addr string // ready once a TCP connection to Addr can be made, if set
+	Cmd  string // else ready once Cmd exits successfully
+}
+
+// Output is declared by a line "@output glob" in a target, naming files the
+// target produces, relative to the directory of the makefile like the globs
+// it depends on.
+type Output struct {
+	Pos  Pos
+	Glob string
 }
 
 type Dependency struct {
@@ -81,9 +104,11 @@ func (m *Makefile) drainParser(input io.Reader) error {
 				}
 			}
 			m.Imports[s.Name] = &Import{
-				Pos:  Pos(s.PathPos),
-				Name: s.Name,
-				Path: s.Path,
+				Pos:    Pos(s.PathPos),
+				Name:   s.Name,
+				Path:   s.Path,
+				Doc:    s.Doc,
+				DocPos: Pos(s.DocPos),
 			}
 		case parse.TargetStatement:
 			if m.Targets[s.Name] != nil {
@@ -97,17 +122,31 @@ func (m *Makefile) drainParser(input io.Reader) error {
 				deps[i].Target = v // As a first put them all in Target, we will seperate later
 				deps[i].Pos = Pos(s.DepsPos[i])
 			}
-			cmds := make([]Command, len(s.Cmds))
+			t := &Target{
+				Pos:     Pos(s.NamePos),
+				Name:    s.Name,
+				Deps:    deps, // TOOD: Need to attach positions here.
+				Cmds:    make([]Command, 0, len(s.Cmds)),
+				Service: s.Service,
+				Doc:     s.Doc,
+				DocPos:  Pos(s.DocPos),
+			}
 			for i, v := range s.Cmds {
-				cmds[i].Cmd = v // As a first put them all in Target, we will seperate later
-				cmds[i].Pos = Pos(s.CmdsPos[i])
+				if strings.HasPrefix(v, "@") {
+					if err := t.directive(v, Pos(s.CmdsPos[i])); err != nil {
+						return err
+					}
+					continue
+				}
+				t.Cmds = append(t.Cmds, Command{Pos: Pos(s.CmdsPos[i]), Cmd: v})
 			}
-			m.Targets[s.Name] = &Target{
-				Pos:  Pos(s.NamePos),
-				Name: s.Name,
-				Deps: deps, // TOOD: Need to attach positions here.
-				Cmds: cmds,
+			if t.Service && len(t.Cmds) == 0 {
+				return ParseError{
+					Err: "a service must have a command to run",
+					Pos: t.Pos,
+				}
 			}
+			m.Targets[s.Name] = t
 		case parse.ErrorStatement:
 			return ParseError{
 				Pos: Pos(s.Pos),
@@ -120,6 +159,36 @@ func (m *Makefile) drainParser(input io.Reader) error {
 	return nil
 }
 
+// directive handles a command line starting with @, which configures the target
+// rather than being run.
+func (t *Target) directive(line string, pos Pos) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "@ready":
+		if !t.Service {
+			return ParseError{Err: "@ready is only allowed in a service", Pos: pos}
+		}
+		if len(fields) == 3 && fields[1] == "tcp" {
+			t.Ready = &Ready{Pos: pos, Addr: fields[2]}
+		} else if len(fields) > 1 {
+			t.Ready = &Ready{Pos: pos, Cmd: strings.TrimSpace(strings.TrimPrefix(line, "@ready"))}
+		} else {
+			return ParseError{Err: "expected a command or tcp address after @ready", Pos: pos}
+		}
+		return nil
+	case "@output":
+		if t.Service {
+			return ParseError{Err: "@output is not allowed in a service", Pos: pos}
+		}
+		if len(fields) != 2 {
+			return ParseError{Err: "expected a single glob after @output", Pos: pos}
+		}
+		t.Outputs = append(t.Outputs, Output{Pos: pos, Glob: fields[1]})
+		return nil
+	}
+	return ParseError{Err: "unknown directive: '" + fields[0] + "'", Pos: pos}
+}
+
 func (m *Makefile) check() error {
 	// run through all targets, splitting the deps into either local target,
 	// imported target or file based on what is defined.
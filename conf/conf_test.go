@@ -126,3 +126,73 @@ func d(p Pos, t, i, f string) Dependency {
 func c(p Pos, c string) Command {
 	return Command{p, c}
 }
+
+func TestDoc(tt *testing.T) {
+	src := `# imported
+import "a" as a
+
+# does
+# stuff
+b: a.c
+`
+	m := m(
+		[]*Import{
+			{Pos: p(2, 8, 1), Path: "a", Name: "a", Doc: "imported", DocPos: p(1, 0, 10)},
+		},
+		[]*Target{
+			{Pos: p(6, 0, 1), Name: "b", Deps: []Dependency{d(p(6, 3, 3), "c", "a", "")},
+				Cmds: []Command{}, Doc: "does\nstuff", DocPos: p(4, 0, 6)},
+		})
+	check(tt, src, m)
+}
+
+func TestService(tt *testing.T) {
+	src := `service web: a
+	build
+	@ready tcp localhost:8080
+	serve
+`
+	m := m(nil,
+		[]*Target{
+			{Pos: p(1, 8, 3), Name: "web", Deps: []Dependency{d(p(1, 13, 1), "", "", "a")},
+				Cmds:    []Command{c(p(2, 1, 5), "build"), c(p(4, 1, 5), "serve")},
+				Service: true, Ready: &Ready{Pos: p(3, 1, 25), Addr: "localhost:8080"}},
+		})
+	check(tt, src, m)
+}
+
+func TestErrorDirectives(tt *testing.T) {
+	ensure(tt, "a:\n\t@ready true\n\tcmd\n")
+	ensure(tt, "service a:\n\t@unknown\n\tcmd\n")
+	ensure(tt, "service a:\n\t@ready\n\tcmd\n")
+	ensure(tt, "service a:\n\t@ready true\n")
+	ensure(tt, "a:\n\t@output\n\tcmd\n")
+	ensure(tt, "a:\n\t@output a b\n\tcmd\n")
+	ensure(tt, "service a:\n\t@output a\n\tcmd\n")
+}
+
+func TestOutput(tt *testing.T) {
+	src := `a: b
+	@output bin/*
+	build
+`
+	m := m(nil,
+		[]*Target{
+			{Pos: p(1, 0, 1), Name: "a", Deps: []Dependency{d(p(1, 3, 1), "", "", "b")},
+				Cmds:    []Command{c(p(3, 1, 5), "build")},
+				Outputs: []Output{{Pos: p(2, 1, 13), Glob: "bin/*"}}},
+		})
+	check(tt, src, m)
+}
+
+func TestPrefixedGlobs(tt *testing.T) {
+	src := `a: b !b +c
+b:
+`
+	m := m(nil,
+		[]*Target{
+			t(p(1, 0, 1), "a", []Dependency{d(p(1, 3, 1), "b", "", ""), d(p(1, 5, 2), "", "", "!b"), d(p(1, 8, 2), "", "", "+c")}, []Command{}),
+			t(p(2, 0, 1), "b", []Dependency{}, []Command{}),
+		})
+	check(tt, src, m)
+}
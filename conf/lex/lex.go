@@ -171,6 +171,11 @@ func (l *Lexer) lexRuleOrStatement() lexState {
 		l.tokenBuffer.Type = Target
 		return l.lexRuleColon
 	}
+	if l.tokenBuffer.Val == "service" && isNameCharacter(l.peek()) {
+		// the kind of target, the name follows
+		l.tokenBuffer.Type = Keyword
+		return l.lexRuleOrStatement
+	}
 	return l.error("':' or '\"'")
 }
 
@@ -241,6 +246,9 @@ func (l *Lexer) lexDep() lexState {
 	if isNewline(l.peek()) {
 		return l.lexNewline
 	}
+	if r := l.next(); r != '!' && r != '+' {
+		l.backup() // only a glob may be prefixed, by ! to exclude or + to not ignore
+	}
 	if l.accept(isDepCharacter) <= 0 {
 		return l.error("dependency or newline")
 	}
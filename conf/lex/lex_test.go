@@ -17,12 +17,16 @@ var testCases = map[string]testcase{
 	"importel": tc(`import "kalle/peter" as peter
 `,
 		t(Keyword, "import"), t(ImportPath, "kalle/peter"), t(Keyword, "as"), t(ImportName, "peter"), t(Newline, "\n"), t(EOF, "")),
+	"service": tc(`service web: a`,
+		t(Keyword, "service"), t(Target, "web"), t(Colon, ":"), t(Dependency, "a"), t(EOF, "")),
 	"emptyrule": tc(`tgt:`,
 		t(Target, "tgt"), t(Colon, ":"), t(EOF, "")),
 	"importtule": tc(`import:`,
 		t(Target, "import"), t(Colon, ":"), t(EOF, "")),
 	"deps": tc(`import: a b/**.py d`,
 		t(Target, "import"), t(Colon, ":"), t(Dependency, "a"), t(Dependency, "b/**.py"), t(Dependency, "d"), t(EOF, "")),
+	"prefixed": tc(`a: src/** !src/**/x/** +b`,
+		t(Target, "a"), t(Colon, ":"), t(Dependency, "src/**"), t(Dependency, "!src/**/x/**"), t(Dependency, "+b"), t(EOF, "")),
 	"commands": tc(`import:
   cmd1
   cmd2`,
@@ -3,6 +3,7 @@ package parse
 
 import (
 	"io"
+	"strings"
 	"sync"
 
 	"github.com/vron/mbs/conf/lex"
@@ -14,6 +15,7 @@ type Parser struct {
 	Statements chan Statement
 
 	buff, last *lex.Token
+	doc        []lex.Token // comment lines that may document the next statement
 
 	mu sync.Mutex
 
@@ -70,11 +72,32 @@ type parseState func() parseState
 func (p *Parser) eatCommentNewline() {
 	tok := p.next()
 	for tok.Type == lex.Newline || tok.Type == lex.Comment {
+		if tok.Type == lex.Comment && tok.Pos.Column == 0 {
+			// only keep comments on consecutive lines of their own
+			if len(p.doc) > 0 && p.doc[len(p.doc)-1].Pos.Line != tok.Pos.Line-1 {
+				p.doc = p.doc[:0]
+			}
+			p.doc = append(p.doc, tok)
+		}
 		tok = p.next()
 	}
 	p.backup()
 }
 
+// takeDoc returns the comment lines directly preceding line and forgets
+// about all collected comments.
+func (p *Parser) takeDoc(line int) (doc string, pos lex.Pos) {
+	defer func() { p.doc = p.doc[:0] }()
+	if len(p.doc) == 0 || p.doc[len(p.doc)-1].Pos.Line != line-1 {
+		return "", lex.Pos{}
+	}
+	lines := make([]string, len(p.doc))
+	for i, t := range p.doc {
+		lines[i] = strings.TrimPrefix(strings.TrimPrefix(t.Val, "#"), " ")
+	}
+	return strings.Join(lines, "\n"), p.doc[0].Pos
+}
+
 func (p *Parser) parseStatement() parseState {
 	// a statement is either and import pr a target, i.e we expect the line
 	// not to start with an indent..
@@ -82,6 +105,7 @@ func (p *Parser) parseStatement() parseState {
 	// TODO: Make this work a lot better to find error case
 	p.eatCommentNewline()
 	tok := p.next()
+	doc, docPos := p.takeDoc(tok.Pos.Line)
 
 	if tok.Type == lex.Keyword && tok.Val == "import" {
 		path := p.next()
@@ -108,10 +132,20 @@ func (p *Parser) parseStatement() parseState {
 			PathPos: path.Pos,
 			Name:    name.Val,
 			NamePos: name.Pos,
+			Doc:     doc,
+			DocPos:  docPos,
 		}
 		return p.parseStatement
 	}
 
+	service := false
+	if tok.Type == lex.Keyword && tok.Val == "service" {
+		service = true
+		if tok = p.next(); tok.Type != lex.Target {
+			return p.error("expected target after service", tok)
+		}
+	}
+
 	if tok.Type == lex.Target {
 		colon := p.next()
 		if colon.Type != lex.Colon {
@@ -129,10 +163,7 @@ func (p *Parser) parseStatement() parseState {
 		p.backup()
 
 		// eat comments and a newline
-		for tok := p.next(); tok.Type == lex.Newline || tok.Type == lex.Comment; {
-			tok = p.next()
-		}
-		p.backup()
+		p.eatCommentNewline()
 
 		// Now we have to options, either the next line is a indent + a command
 		// or it is something else, in which case we parse it separately.
@@ -155,6 +186,9 @@ func (p *Parser) parseStatement() parseState {
 			DepsPos: depspos,
 			Cmds:    cmds,
 			CmdsPos: cmdspos,
+			Service: service,
+			Doc:     doc,
+			DocPos:  docPos,
 		}
 
 		return p.parseStatement
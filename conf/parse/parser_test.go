@@ -140,3 +140,55 @@ func equal(a, b Statement) bool {
 
 	return true
 }
+
+func TestDoc(t *testing.T) {
+	stms := run(`# not attached
+
+# the import
+import "a" as a
+# the target
+#spans two lines
+tgt: dep # trailing
+	cmd
+# not attached, since followed by a blank line
+
+other:
+# other is documented
+third:
+`, t)
+	docs := []string{"the import", "the target\nspans two lines", "", "other is documented"}
+	if len(stms) != len(docs) {
+		t.Fatal("bad number of statements", stms)
+	}
+	for i, d := range docs {
+		var doc string
+		switch s := stms[i].(type) {
+		case ImportStatement:
+			doc = s.Doc
+		case TargetStatement:
+			doc = s.Doc
+		}
+		if doc != d {
+			t.Errorf("%d: got doc %q but expected %q", i, doc, d)
+		}
+	}
+	if ts := stms[1].(TargetStatement); ts.DocPos.Line != 5 || ts.DocPos.Column != 0 {
+		t.Error("bad doc position", ts.DocPos)
+	}
+}
+
+func TestService(t *testing.T) {
+	stms := run(`service web: a
+	server
+service:
+`, t)
+	if len(stms) != 2 {
+		t.Fatal("bad number of statements", stms)
+	}
+	if ts := stms[0].(TargetStatement); !ts.Service || ts.Name != "web" || len(ts.Cmds) != 1 {
+		t.Error("expected a service", ts)
+	}
+	if ts := stms[1].(TargetStatement); ts.Service || ts.Name != "service" {
+		t.Error("expected a target named service", ts)
+	}
+}
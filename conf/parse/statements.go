@@ -15,6 +15,9 @@ type TargetStatement struct {
 	DepsPos []lex.Pos
 	Cmds    []string
 	CmdsPos []lex.Pos
+	Service bool   // the last command keeps running
+	Doc     string // comment lines directly above the target, without '#'
+	DocPos  lex.Pos
 }
 
 // TODO: handle filenames with spaces by quotes
@@ -26,6 +29,8 @@ type ImportStatement struct {
 	NamePos lex.Pos
 	Path    string
 	PathPos lex.Pos
+	Doc     string // comment lines directly above the import, without '#'
+	DocPos  lex.Pos
 }
 
 // A ErrorStatement reports an error occuring during the parsing
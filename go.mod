@@ -4,14 +4,14 @@ go 1.13
 
 require (
 	github.com/bmatcuk/doublestar v1.1.5
-	github.com/boltdb/bolt v1.3.1
 	github.com/gobwas/glob v0.2.3
 	github.com/juju/errgo v0.0.0-20140925100237-08cceb5d0b53
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/pkg/sftp v1.10.1 // indirect
 	github.com/shibukawa/configdir v0.0.0-20170330084843-e180dbdc8da0
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/net v0.0.0-20191109021931-daa7c04131f5 // indirect
-	golang.org/x/sys v0.0.0-20191104094858-e8c54fb511f6 // indirect
+	golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d
 	golang.org/x/text v0.3.2
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 )
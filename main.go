@@ -3,48 +3,210 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/shibukawa/configdir"
+	"github.com/vron/mbs/artifact"
 	"github.com/vron/mbs/cache"
 	"github.com/vron/mbs/mbs"
+	"github.com/vron/mbs/remote"
 )
 
 var (
 	fVerbose     bool
 	fVeryVerbose bool
 	fHelp        bool
-	fClearCache  bool
+	fClearCache  clearScope
+	fCache       string
+	fProject     string
 	fMakefile    string
+	fGraph       string
+	fList        bool
+	fDeps        string
+	fRDeps       string
+	fTrace       string
+	fSummary     bool
+	fEvents      string
+	fJUnit       string
+	fWatch       bool
+	fHashContent bool
+	fRemoteCache string
+	fLstat       bool
+	fStrict      bool
+	fCacheCmd    bool
+	fCacheGC     bool
+	fCacheGCAge  time.Duration
+	fCacheMax    int64
+
+	prog *progress
 )
 
 func init() {
-	flag.BoolVar(&fVerbose, "v", false, "verbose logging")
+	flag.BoolVar(&fVerbose, "v", false, "show the progress of the build, as a live view on a terminal, and a summary; -summary shows only the summary and -vv the output of the commands instead")
 	flag.BoolVar(&fVeryVerbose, "vv", false, "very verbose logging")
 	flag.BoolVar(&fHelp, "h", false, "show help information")
-	flag.BoolVar(&fClearCache, "clear-cache", false, "completely wipe the cache")
+	flag.Var(&fClearCache, "clear-cache", "remove everything cached for the project, or with =all wipe the whole cache, or with =<target> remove what is cached for the target, other than one named all or project")
+	flag.StringVar(&fCache, "cache", "", "the cache file to use instead of the one in the user cache directory")
+	flag.StringVar(&fProject, "project", "", "the name under which the project is cached, defaults to the first line of the "+mbs.RootMarker+" file marking the project root, or the path of the root directory")
+	flag.BoolVar(&fCacheCmd, "cache-cmd", false, "run the cache command given by the arguments, the same as 'mbs cache', see 'mbs cache help'")
+	flag.BoolVar(&fCacheGC, "cache-gc", false, "remove cache entries older than -cache-gc-age, or of this project but not used by any of its targets")
+	flag.DurationVar(&fCacheGCAge, "cache-gc-age", 30*24*time.Hour, "remove cache entries not used for this long when collecting garbage")
+	flag.Int64Var(&fCacheMax, "cache-max-size", 256, "collect garbage in the cache when it grows larger than this many MB, 0 to never")
 	flag.StringVar(&fMakefile, "i", "Makefile.mbs", "conf file from which to read configuration")
+	flag.StringVar(&fGraph, "graph", "", "print the target graph as 'dot' or 'json' instead of building")
+	flag.BoolVar(&fList, "list", false, "list all targets with their location and documentation")
+	flag.StringVar(&fDeps, "deps", "", "print everything the given target depends on")
+	flag.StringVar(&fRDeps, "rdeps", "", "print the targets that depend on the given file")
+	flag.BoolVar(&fSummary, "summary", false, "print a summary of the build, implied by -v")
+	flag.StringVar(&fEvents, "events", "", "write progress events to stdout, only 'json' is supported")
+	flag.BoolVar(&fWatch, "watch", false, "rebuild the targets each time the files they depend on change")
+	flag.BoolVar(&fHashContent, "hash-content", false, "detect changes by the contents of files instead of modification times, needed to use an imported cache and to restore declared outputs after switching branches")
+	flag.BoolVar(&fLstat, "lstat", false, "treat symbolic links matched by globs as links rather than as the files they point to")
+	flag.BoolVar(&fStrict, "strict", false, "fail the build if a glob a target depends on matches no files, instead of warning")
+	flag.StringVar(&fRemoteCache, "remote-cache", "", "share the declared outputs of targets, and which targets with outputs are clean, through the server at this URL, see 'mbs cache-server -h'")
+	flag.StringVar(&fJUnit, "junit", "", "write a JUnit XML report of the targets to this file")
+	flag.StringVar(&fTrace, "trace", "", "write a timeline of the build in the Chrome trace event format to this file")
 }
 
 func main() {
 	targets, options := handleArgs()
 	cache := loadCache()
 
-	b := mbs.NewBuilder(cache, options)
+	b := mbs.NewBuilder(shareCache(cache), options)
+	if fCacheCmd {
+		doCache(b, cache, fMakefile, targets)
+		return
+	}
+	if fClearCache != "" {
+		doClearCache(b, cache, fMakefile, fClearCache.target())
+		return
+	}
+	if fCacheGC {
+		doCacheGC(b, cache, fMakefile)
+		return
+	}
+	autoCacheGC(cache)
+
+	switch {
+	case fGraph != "":
+		doGraph(b, fMakefile, targets)
+	case fList:
+		doList(b, fMakefile)
+	case fDeps != "":
+		doDeps(b, fMakefile, fDeps)
+	case fRDeps != "":
+		doRDeps(b, fMakefile, fRDeps)
+	default:
+		doBuild(b, fMakefile, targets)
+	}
+}
+
+func doList(b *mbs.Builder, makefile string) {
+	infos, err := b.List(makefile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printTargets(infos)
+}
+
+func doRDeps(b *mbs.Builder, makefile, file string) {
+	infos, err := b.RDeps(makefile, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printTargets(infos)
+}
+
+func printTargets(infos []mbs.TargetInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, info := range infos {
+		doc := strings.SplitN(info.Doc, "\n", 2)[0]
+		fmt.Fprintf(w, "%s\t%s:%d\t%s\n", info.Name, relPath(info.Makefile), info.Line, doc)
+	}
+	w.Flush()
+}
+
+func doDeps(b *mbs.Builder, makefile, target string) {
+	g, err := b.Graph(context.Background(), makefile, []string{target})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	byID := map[string]mbs.GraphTarget{}
+	for _, t := range g.Targets {
+		byID[t.ID] = t
+	}
+	printed := map[string]bool{}
+	var print func(t mbs.GraphTarget, indent string)
+	print = func(t mbs.GraphTarget, indent string) {
+		state := "dirty"
+		if t.Clean {
+			state = "clean"
+		}
+		fmt.Printf("%s%s (%s:%d, %s)\n", indent, t.Name, relPath(t.Makefile), t.Line, state)
+		if printed[t.ID] {
+			return // allready expanded above
+		}
+		printed[t.ID] = true
+		for _, gl := range t.Globs {
+			fmt.Printf("%s  %s\n", indent, relPath(filepath.Join(filepath.Dir(t.Makefile), gl)))
+		}
+		for _, d := range t.Deps {
+			print(byID[d], indent+"  ")
+		}
+	}
+	print(g.Targets[0], "")
+}
+
+// relPath makes path relative to the working directory if possible.
+func relPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil {
+		return rel
+	}
+	return path
+}
 
-	doBuild(b, fMakefile, targets)
+func doGraph(b *mbs.Builder, makefile string, targets []string) {
+	g, err := b.Graph(context.Background(), makefile, targets)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	switch fGraph {
+	case "dot":
+		err = g.WriteDot(os.Stdout)
+	case "json":
+		err = g.WriteJSON(os.Stdout)
+	default:
+		err = errors.New("unknown graph format: " + fGraph)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
 func doBuild(b *mbs.Builder, makefile string, targets []string) {
 	ctx, cf := context.WithCancel(context.Background())
-	stopped := make(chan struct{}, 0)
+	stopped := make(chan struct{}, 1)
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
@@ -52,7 +214,30 @@ func doBuild(b *mbs.Builder, makefile string, targets []string) {
 		stopped <- struct{}{}
 	}()
 
-	if err := b.Build(ctx, makefile, targets); err != nil {
+	var err error
+	if fWatch {
+		err = b.Watch(ctx, makefile, targets, func(err error) {
+			reportBuild(b, err)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Fprintln(os.Stderr, "watching for changes")
+		})
+	} else {
+		err = b.Build(ctx, makefile, targets)
+		reportBuild(b, err)
+		if s := b.Services(); err == nil && len(s) > 0 {
+			fmt.Fprintln(os.Stderr, "services running: "+strings.Join(s, ", ")+", interrupt to stop")
+			<-stopped
+		}
+	}
+	b.StopServices()
+	if f, ok := b.Options.Trace.(*os.File); ok {
+		if cerr := f.Close(); cerr != nil {
+			fmt.Fprintln(os.Stderr, "error writing trace: "+cerr.Error())
+		}
+	}
+	if err != nil {
 		select {
 		case <-stopped:
 			// we were interupted so simply quit
@@ -65,6 +250,35 @@ func doBuild(b *mbs.Builder, makefile string, targets []string) {
 	}
 }
 
+// reportBuild outputs what is requested about a finished build.
+func reportBuild(b *mbs.Builder, err error) {
+	if prog != nil {
+		prog.close()
+		if fWatch {
+			prog = newProgress(os.Stdout) // for the next build
+		}
+	}
+	if fSummary || fVerbose || fVeryVerbose {
+		fmt.Fprint(os.Stderr, b.Summary())
+	}
+	if fJUnit != "" {
+		writeJUnit(b.Summary(), fJUnit)
+	}
+}
+
+func writeJUnit(s mbs.Summary, path string) {
+	f, err := os.Create(path)
+	if err == nil {
+		err = s.WriteJUnit(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error writing junit report: "+err.Error())
+	}
+}
+
 func handleArgs() (targets []string, options mbs.Options) {
 	flag.Parse()
 	if fHelp {
@@ -72,16 +286,31 @@ func handleArgs() (targets []string, options mbs.Options) {
 		os.Exit(1)
 	}
 
-	if fClearCache {
+	if fClearCache == "all" {
 		clearCache()
 		os.Exit(0)
 	}
 
 	targets = flag.Args()
+	// not a valid target name, so never a target
+	if len(targets) > 0 && targets[0] == "cache-server" {
+		// serves the store of other checkouts, not that of this one
+		doCacheServer(targets[1:])
+		os.Exit(1)
+	}
+	if isCommand(targets, "cache") {
+		fCacheCmd, targets = true, targets[1:]
+	}
 	options = createOptions()
 	return
 }
 
+// isCommand reports if args, the arguments after the flags, start with the
+// command name rather than a target of that name, which is given after "--".
+func isCommand(args []string, name string) bool {
+	return len(args) > 0 && args[0] == name && os.Args[len(os.Args)-len(args)-1] != "--"
+}
+
 func createOptions() (o mbs.Options) {
 	if fVerbose || fVeryVerbose {
 		o.LogCommands = true
@@ -89,11 +318,44 @@ func createOptions() (o mbs.Options) {
 	if fVeryVerbose {
 		o.LogOutput = true
 	}
+	o.HashContent = fHashContent
+	o.Lstat = fLstat
+	o.StrictGlobs = fStrict
+	o.Artifacts = loadArtifacts()
+	if fRemoteCache != "" {
+		o.Artifacts.Remote = remote.NewClient(fRemoteCache)
+	}
+	if fTrace != "" {
+		f, err := os.Create(fTrace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		o.Trace = f // closed by doBuild
+	}
+	switch fEvents {
+	case "":
+		if fVerbose && !fVeryVerbose {
+			prog = newProgress(os.Stdout)
+			o.Events = func(e mbs.Event) { prog.event(e) }
+		}
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		o.Events = func(e mbs.Event) {
+			enc.Encode(e)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown event format: "+fEvents)
+		os.Exit(1)
+	}
 
 	return
 }
 
 func getCachePath() string {
+	if fCache != "" {
+		return fCache
+	}
 	configDirs := configdir.New("vron", "mbs")
 	cf := configDirs.QueryCacheFolder()
 	err := os.MkdirAll(cf.Path, 0700)
@@ -103,15 +365,146 @@ func getCachePath() string {
 	return filepath.Join(cf.Path, "cache.db")
 }
 
+// loadArtifacts opens the store of target outputs next to the cache file.
+func loadArtifacts() *artifact.Store {
+	s, err := artifact.Open(filepath.Join(filepath.Dir(getCachePath()), "artifacts"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return s
+}
+
+// shareCache returns the store of builds, which is c unless it is shared
+// through a remote cache.
+func shareCache(c *cache.Cache) cache.Store {
+	if fRemoteCache == "" {
+		return c
+	}
+	return cache.NewShared(c, projectName(), remote.NewClient(fRemoteCache))
+}
+
 func loadCache() *cache.Cache {
 	c, err := cache.Open(getCachePath())
-	if err != nil {
+	if err == nil {
+		c = c.Project(projectName())
+	}
+	if _, ok := err.(*cache.VersionError); ok {
+		fmt.Fprintln(os.Stderr, err.Error()+", upgrade mbs or use -clear-cache")
+		os.Exit(1)
+	} else if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 	return c
 }
 
+// doCacheGC removes the old entries and those of the project that are not
+// used by any of its targets.
+func doCacheGC(b *mbs.Builder, c *cache.Cache, makefile string) {
+	keys, err := b.CacheKeys(makefile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	s, err := c.GC(cache.GCOptions{
+		Before:  time.Now().Add(-fCacheGCAge),
+		Keep:    func(key string) bool { return keys[key] != nil },
+		MaxSize: fCacheMax << 20,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error collecting garbage in cache: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("removed %d entries, kept %d, cache is %d kB\n", s.Removed, s.Kept, s.Size>>10)
+}
+
+// autoCacheGC collects garbage if the cache has grown too large.
+func autoCacheGC(c *cache.Cache) {
+	size, err := c.Size()
+	if fCacheMax <= 0 || err != nil || size <= fCacheMax<<20 {
+		return
+	}
+	s, err := c.GC(cache.GCOptions{
+		Before:  time.Now().Add(-fCacheGCAge),
+		MaxSize: fCacheMax << 20,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error collecting garbage in cache: "+err.Error())
+	} else if fVerbose || fVeryVerbose {
+		fmt.Fprintf(os.Stderr, "cache was %d MB, removed %d entries\n", size>>20, s.Removed)
+	}
+}
+
+// projectName returns the name of the project in the cache.
+func projectName() string {
+	if fProject != "" {
+		return fProject
+	}
+	_, name, err := mbs.FindRoot(fMakefile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return name
+}
+
+// clearScope is what -clear-cache clears, all, project or the name of a
+// target, and empty if not given.
+type clearScope string
+
+func (s *clearScope) String() string {
+	return string(*s)
+}
+
+func (s *clearScope) Set(v string) error {
+	switch v {
+	case "true":
+		v = "project" // given without a value
+	case "false":
+		v = ""
+	}
+	*s = clearScope(v)
+	return nil
+}
+
+func (s *clearScope) IsBoolFlag() bool {
+	return true
+}
+
+// target returns the target to clear, empty for the whole project.
+func (s clearScope) target() string {
+	if s == "project" {
+		return ""
+	}
+	return string(s)
+}
+
+// doClearCache removes the entries of the project, or only of the target if
+// one is given, from the cache.
+func doClearCache(b *mbs.Builder, c *cache.Cache, makefile, target string) {
+	if target == "" {
+		if err := c.Clear(); err != nil {
+			fmt.Fprintln(os.Stderr, "error clearing cache: "+err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	keys, err := b.TargetCacheKeys(makefile, target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	del := []string{}
+	for k := range keys {
+		del = append(del, k)
+	}
+	if err := c.Delete(del...); err != nil {
+		fmt.Fprintln(os.Stderr, "error clearing cache: "+err.Error())
+		os.Exit(1)
+	}
+}
+
 func clearCache() {
 	err := os.Remove(getCachePath())
 	if err != nil && !os.IsNotExist(err) {
@@ -121,5 +514,6 @@ func clearCache() {
 }
 
 func showHelp() {
+	fmt.Fprintln(os.Stderr, "usage: mbs [flags] [targets]\n       mbs [flags] cache ls|show|rm|stats|export|import\n       mbs cache-server [-addr host:port] dir\n\nflags:")
 	flag.PrintDefaults()
 }
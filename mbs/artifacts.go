@@ -0,0 +1,71 @@
+package mbs
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// restoreOutputs restores the outputs of t from the artifact store, returning
+// false if t must be run instead.
+func (b *Builder) restoreOutputs(t *target) bool {
+	if b.Options.Artifacts == nil || len(t.t.Outputs) == 0 {
+		return false
+	}
+	ok, err := b.Options.Artifacts.Restore(hex.EncodeToString(t.fingerprint), t.path)
+	if err != nil {
+		fmt.Fprintln(b.Options.Stderr, "error restoring outputs of "+t.String()+", running it: "+err.Error())
+		return false
+	}
+	return ok
+}
+
+// shared reports if what is cached for t may be shared with other machines,
+// which is if its outputs are stored, so that a machine finding t clean by
+// what was built on another restores them rather than trusting that they
+// exist. Targets without declared outputs may have effects that are not
+// restored, so they are run on each machine.
+func (b *Builder) shared(t *target) bool {
+	return t.t != nil && b.Options.Artifacts != nil && len(t.t.Outputs) > 0
+}
+
+// outputsMissing reports if a declared output of t matches no files, so that
+// t must be restored or run again.
+func (b *Builder) outputsMissing(t *target) bool {
+	for _, o := range t.t.Outputs {
+		matches, err := doublestar.Glob(filepath.Join(t.path, o.Glob))
+		if err == nil && len(matches) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// storeOutputs stores the outputs of t, which was just run successfully, in
+// the artifact store. Failing to do so does not fail the build.
+func (b *Builder) storeOutputs(t *target) {
+	if b.Options.Artifacts == nil || len(t.t.Outputs) == 0 {
+		return
+	}
+	files := []string{}
+	for _, o := range t.t.Outputs {
+		matches, err := doublestar.Glob(filepath.Join(t.path, o.Glob))
+		if err != nil {
+			fmt.Fprintln(b.Options.Stderr, "error storing outputs of "+t.String()+": "+err.Error())
+			return
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(t.path, m)
+			if err != nil {
+				continue
+			}
+			files = append(files, rel)
+		}
+	}
+	err := b.Options.Artifacts.Put(hex.EncodeToString(t.fingerprint), t.path, files)
+	if err != nil {
+		fmt.Fprintln(b.Options.Stderr, "error storing outputs of "+t.String()+": "+err.Error())
+	}
+}
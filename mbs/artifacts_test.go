@@ -0,0 +1,144 @@
+package mbs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/vron/mbs/artifact"
+	"github.com/vron/mbs/cache"
+)
+
+func TestArtifacts(t *testing.T) {
+	mf := `
+all: src/python/*.py
+	@output out/*
+	echo built
+	mkdir -p test/data/out && cat test/data/src/python/a.py > test/data/out/a
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	write("src/python/a.py", "first")
+	s, err := artifact.Open("test/artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(output, state string) {
+		t.Helper()
+		out, b, err := runBuild(store, Options{HashContent: true, Artifacts: s}, "all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != output {
+			t.Errorf("expected output %q, got %q", output, out)
+		}
+		sum := b.Summary()
+		restored := 0
+		if state == ResultRestored {
+			restored = 1
+		}
+		if len(sum.Results) != 1 || sum.Results[0].State != state || sum.Restored != restored {
+			t.Errorf("expected the target to be %s, got %+v", state, sum)
+		}
+	}
+	out := func(data string) {
+		t.Helper()
+		if b, err := ioutil.ReadFile("test/data/out/a"); err != nil || string(b) != data {
+			t.Errorf("expected output file %q, got %q %v", data, b, err)
+		}
+	}
+
+	build("built\n", ResultRun)
+	out("first")
+	write("src/python/a.py", "second")
+	build("built\n", ResultRun)
+	out("second")
+	build("", ResultClean)
+
+	// as when switching back to a branch built before
+	write("src/python/a.py", "first")
+	build("", ResultRestored)
+	out("first")
+}
+
+// fakeRemote keeps the entries of a remote cache in memory.
+type fakeRemote struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (r *fakeRemote) Get(kind, name string, w io.Writer) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[kind+"/"+name]
+	w.Write(e)
+	return ok, nil
+}
+
+func (r *fakeRemote) Put(kind, name string, rd io.Reader) error {
+	e, err := ioutil.ReadAll(rd)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[kind+"/"+name] = e
+	return err
+}
+
+func TestSharedCache(t *testing.T) {
+	mf := `
+all: check src/python/*.py
+	@output out/*
+	echo built
+	mkdir -p test/data/out && cat test/data/src/python/a.py > test/data/out/a
+check: src/python/*.py
+	echo checked
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	write("src/python/a.py", "first")
+	r := &fakeRemote{entries: map[string][]byte{}}
+
+	// each build is on a machine of its own, sharing only the remote
+	machine := 0
+	build := func(output string, states map[string]string) {
+		t.Helper()
+		machine++
+		s, err := artifact.Open("test/artifacts" + strconv.Itoa(machine))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Remote = r
+		os.RemoveAll("test/data/out")
+		c := cache.NewShared(cache.NewMemory(), "p", r)
+		defer c.Close()
+		out, b, err := runBuild(c, Options{HashContent: true, Artifacts: s}, "all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != output {
+			t.Errorf("expected output %q, got %q", output, out)
+		}
+		for _, res := range b.Summary().Results {
+			if res.State != states[res.Name] {
+				t.Errorf("expected %s to be %s, got %s", res.Name, states[res.Name], res.State)
+			}
+		}
+		if err := c.Err(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	build("checked\nbuilt\n", map[string]string{"check": ResultRun, "all": ResultRun})
+	// check has no outputs to restore so it is run on each machine, the
+	// missing output of all is restored
+	build("checked\n", map[string]string{"check": ResultRun, "all": ResultRestored})
+	if b, err := ioutil.ReadFile("test/data/out/a"); err != nil || string(b) != "first" {
+		t.Errorf("expected the restored output, got %q %v", b, err)
+	}
+	write("src/python/a.py", "second")
+	build("checked\nbuilt\n", map[string]string{"check": ResultRun, "all": ResultRun})
+}
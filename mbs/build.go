@@ -3,11 +3,17 @@ package mbs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/vron/mbs/artifact"
 	"github.com/vron/mbs/cache"
+	"github.com/vron/mbs/conf"
+	"github.com/vron/mbs/stat"
 )
 
 // Options configure how the builder should operate
@@ -19,36 +25,110 @@ type Options struct {
 	Stdout io.Writer
 	// If nil os.Stderr will be used
 	Stderr io.Writer
+	// If not nil a timeline of the build, in the Chrome trace event format, is
+	// written to Trace when the build is done. A file is rewritten by each
+	// build, so that it holds the trace of the last one, as when watching.
+	Trace io.Writer
+	// If not nil Events is called, never concurrently, as the build progresses.
+	Events func(Event)
+	// HashContent makes the contents of files, rather than their modification
+	// times, decide if they have changed, so that the cache can be used in
+	// another checkout of the same files.
+	HashContent bool
+	// Lstat makes symbolic links matched by globs count as themselves rather
+	// than as the files they point to.
+	Lstat bool
+	// StrictGlobs fails a build with globs that match no files, instead of
+	// only warning about them.
+	StrictGlobs bool
+	// Root is the directory cache keys are relative to, if empty it is found
+	// by FindRoot.
+	Root string
+	// If not nil the outputs declared by targets are stored in Artifacts
+	// after they are run, and restored from it instead of running them when
+	// their inputs are the same as in an earlier build.
+	Artifacts *artifact.Store
 }
 
+// Measures holds the time spent in each phase of a build.
 type Measures struct {
+	TimeParse time.Duration // reading makefiles, part of TimeGraph
 	TimeGraph time.Duration
+	TimeStat  time.Duration
+	TimeRun   time.Duration
 }
 
 type Builder struct {
 	Options
 
-	cache *cache.Cache
+	cache  cache.Store
+	batch  *cache.Batch // writes of a build, committed when it is done
+	stater *stat.Stater
+	root   string               // of the project, see setRoot
+	fresh  map[string]freshHash // known hashes of globs while watching, by glob key
 
-	targets map[string]*target
+	cacheErr error       // last reported by reportCacheErr
+	empty    []emptyGlob // found by checkFiles, see checkEmpty
+
+	targets   map[string]*target
+	makefiles map[string]*conf.Makefile
+	tracer    *tracer
+	visiting  []*target // by visitTarget, to report cycles
+	summary   Summary
+	resultIdx map[*target]int // index in summary.Results
+	eventsMu  sync.Mutex
+
+	services   map[string]*service // by target key
+	servicesMu sync.Mutex
 }
 
-func NewBuilder(c *cache.Cache, o Options) *Builder {
+func NewBuilder(c cache.Store, o Options) *Builder {
+	if o.Stdout == nil {
+		o.Stdout = os.Stdout
+	}
+	if o.Stderr == nil {
+		o.Stderr = os.Stderr
+	}
 	b := &Builder{
-		Options: o,
-		targets: make(map[string]*target, 100),
-		cache:   c,
+		Options:   o,
+		targets:   make(map[string]*target, 100),
+		makefiles: make(map[string]*conf.Makefile, 10),
+		cache:     c,
+		batch:     c.Begin(),
+		stater:    stat.New(stat.Options{Content: o.HashContent, Lstat: o.Lstat}),
+		services:  map[string]*service{},
 	}
 	return b
 }
 
-func (b *Builder) Build(ctx context.Context, makefile string, targets []string) error {
-	makefile, err := filepath.Abs(makefile)
+func (b *Builder) Build(ctx context.Context, makefile string, targets []string) (err error) {
+	makefile, err = filepath.Abs(makefile)
 	if err != nil {
 		return errors.New("error reading makefile: " + err.Error())
 	}
+	if b.Options.Trace != nil {
+		b.tracer = newTracer()
+		defer func() {
+			if terr := b.tracer.write(b.Options.Trace, maxWorkers); err == nil {
+				err = terr
+			}
+			b.tracer = nil
+		}()
+	}
 
+	if err := b.setRoot(makefile); err != nil {
+		return err
+	}
+	b.targets = make(map[string]*target, len(b.targets))
+	b.empty = nil
+	b.summary = Summary{}
+	files := b.stater.Files()
+	defer func() { b.summary.FilesStated = b.stater.Files() - files }()
+
+	start := time.Now()
 	dag, err := b.buildDAG(ctx, makefile, targets)
+	b.summary.TimeGraph = time.Since(start)
+	b.tracer.span("phase", "dag", 0, start, nil)
 	if err != nil {
 		return err
 	}
@@ -56,15 +136,26 @@ func (b *Builder) Build(ctx context.Context, makefile string, targets []string)
 		return ctx.Err()
 	}
 
+	start = time.Now()
 	err = b.checkFiles(ctx, dag)
+	b.summary.TimeStat = time.Since(start)
+	b.tracer.span("phase", "stat", 0, start, nil)
 	if err != nil {
 		return err
 	}
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
+	b.resultIdx = map[*target]int{}
+	b.countTargets(dag, b.resultIdx)
 
+	start = time.Now()
 	err = b.doRun(ctx, dag)
+	b.summary.TimeRun = time.Since(start)
+	b.tracer.span("phase", "run", 0, start, nil)
+	b.storeFiles(dag)
+	b.batch.Commit() // an error is kept in the cache
+	b.reportCacheErr()
 	if err != nil {
 		return err
 	}
@@ -72,5 +163,16 @@ func (b *Builder) Build(ctx context.Context, makefile string, targets []string)
 		return ctx.Err()
 	}
 
-	return nil
+	return b.checkEmpty()
+}
+
+// reportCacheErr writes an error of the cache to Stderr, once. It does not
+// fail the build since it only means that more may be run than needed.
+func (b *Builder) reportCacheErr() {
+	err := b.cache.Err()
+	if err == nil || err == b.cacheErr {
+		return
+	}
+	b.cacheErr = err
+	fmt.Fprintln(b.Options.Stderr, "warning: "+err.Error())
 }
@@ -24,8 +24,12 @@ func initFs() {
 	write("src/python/b.py")
 	write("src/python/lib/lib.py")
 	rand.Seed(0)
+	store = cache.NewMemory()
 }
 
+// store is the cache used by the tests, emptied by initFs.
+var store *cache.Memory
+
 func cleanFs() {
 	err := os.RemoveAll("./test")
 	if err != nil {
@@ -57,30 +61,31 @@ func write(path string, cont ...string) {
 }
 
 func expect(t *testing.T, target, output string) {
-	c, err := cache.Open("test/cache")
-	if err != nil {
-		t.Error(err)
-		t.FailNow()
+	targets := []string{}
+	if target != "" {
+		targets = append(targets, target)
 	}
-	defer c.Close()
-	buf := bytes.NewBuffer(nil)
-	b := NewBuilder(c, Options{LogOutput: true, Stdout: buf})
-	if target == "" {
-		err = b.Build(context.Background(), "test/data/Makefile", []string{})
-	} else {
-		err = b.Build(context.Background(), "test/data/Makefile", []string{target})
-	}
-
+	out, _, err := runBuild(store, Options{}, targets...)
 	if err != nil {
 		t.Error(err)
 	}
 
-	out := strings.Replace(string(buf.Bytes()), "\n", "", -1)
+	out = strings.Replace(out, "\n", "", -1)
 	if out != output {
 		t.Error("output not matching", "'"+out+"'", "!=", "'"+output+"'")
 	}
 }
 
+// runBuild builds the targets of test/data/Makefile with a new builder on c,
+// returning the output of their commands.
+func runBuild(c cache.Store, o Options, targets ...string) (string, *Builder, error) {
+	buf := &syncBuffer{} // written by the targets run in parallel
+	o.LogOutput, o.Stdout = true, buf
+	b := NewBuilder(c, o)
+	err := b.Build(context.Background(), "test/data/Makefile", targets)
+	return buf.String(), b, err
+}
+
 func TestSimpleDoublestar(t *testing.T) {
 	mf := `
 all: **/*.py
@@ -154,4 +159,217 @@ all: py.b log.txt
 	expect(t, "all", "")
 }
 
+func TestFailed(t *testing.T) {
+	mf := `
+all: a README
+	echo all
+a: src/python/a.py
+	echo a
+	test -f test/data/ok
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	// the hashes of a failed target are not stored, so it is run again
+	if out, _, err := runBuild(store, Options{}, "all"); out != "a\n" || err == nil {
+		t.Error("expected a to fail, got", out, err)
+	}
+	write("ok")
+	if out, _, err := runBuild(store, Options{}, "all"); out != "a\nall\n" || err != nil {
+		t.Error("expected a and all to run, got", out, err)
+	}
+	if out, _, err := runBuild(store, Options{}, "all"); out != "" || err != nil {
+		t.Error("expected nothing to run, got", out, err)
+	}
+}
+
+func TestDefaultOutput(t *testing.T) {
+	// as documented for Options, which logging relied on before
+	b := NewBuilder(cache.NewMemory(), Options{})
+	if b.Options.Stdout != os.Stdout || b.Options.Stderr != os.Stderr {
+		t.Error("expected os.Stdout and os.Stderr by default")
+	}
+}
+
+func TestCommandNotStarted(t *testing.T) {
+	mf := `
+a: src/python/a.py
+	echo a
+	echo b
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	// bash is not found, which is not an exit code of a command
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	out, b, err := runBuild(store, Options{}, "a")
+	if err == nil {
+		t.Error("expected the build to fail")
+	}
+	// the target stops at its first failing command, and fails once
+	if s := b.Summary(); s.Failed != 1 || out != "" {
+		t.Error("expected one failure and no output, got", s.Failed, out)
+	}
+}
+
 // todo: test so folders correct
+
+func TestConcurrentBuilders(t *testing.T) {
+	// each target waits for the other to start, so the builds only finish if
+	// neither keeps the cache locked while running them
+	mf := `
+a: src/python/a.py
+	touch test/a; for i in $(seq 500); do [ -f test/b ] && break; sleep 0.01; done; [ -f test/b ] && echo a
+b: src/python/b.py
+	touch test/b; for i in $(seq 500); do [ -f test/a ] && break; sleep 0.01; done; [ -f test/a ] && echo b
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	// like an mbs process, each build has its own handle on the cache file
+	buildOwn := func(tgt string) string {
+		c, err := cache.Open("test/cache")
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer c.Close()
+		out, _, err := runBuild(c, Options{}, tgt)
+		if err != nil {
+			t.Error(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	done := make(chan string)
+	for _, tgt := range []string{"a", "b"} {
+		go func(tgt string) { done <- buildOwn(tgt) }(tgt)
+	}
+	if o := <-done + <-done; o != "ab" && o != "ba" {
+		t.Error("expected both targets to run, got", o)
+	}
+	if o := buildOwn("a") + buildOwn("b"); o != "" {
+		t.Error("expected both targets to be clean, got", o)
+	}
+}
+
+func TestCorruptCache(t *testing.T) {
+	mf := `
+a: src/python/a.py
+	echo a
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	write("cache", "not a cache")
+
+	c, err := cache.Open("test/data/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	stderr := bytes.NewBuffer(nil)
+	out, b, err := runBuild(c, Options{Stderr: stderr}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "a\n" || !strings.Contains(stderr.String(), "corrupt") {
+		t.Error("expected the build to run and the corrupt cache to be reported, got", out, stderr.String())
+	}
+	stderr.Reset()
+	b.Build(context.Background(), "test/data/Makefile", []string{"a"})
+	if stderr.Len() != 0 {
+		t.Error("expected the error to be reported once, got", stderr.String())
+	}
+}
+
+func TestEmptyGlob(t *testing.T) {
+	mf := `
+gen: README
+	echo gen > test/data/gen.txt
+a: gen gen.txt
+	echo a
+b: missing/*.py
+	echo b
+excluded: src/python/*.py !src/python/*.py
+	echo excluded
+ignored: *.txt
+	echo ignored
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	warnings := func(tgt string, strict bool) (string, error) {
+		stderr := bytes.NewBuffer(nil)
+		_, _, err := runBuild(store, Options{Stderr: stderr, StrictGlobs: strict}, tgt)
+		return stderr.String(), err
+	}
+
+	// produced by the build, so only missing when checked
+	if out, err := warnings("a", true); out != "" || err != nil {
+		t.Error("expected no warning for a generated file, got", out, err)
+	}
+	if out, err := warnings("b", false); !strings.Contains(out, "missing/*.py") || err != nil {
+		t.Error("expected a warning, got", out, err)
+	}
+	if _, err := warnings("b", true); err == nil || !strings.Contains(err.Error(), "missing/*.py") {
+		t.Error("expected an error, got", err)
+	}
+
+	// files that are excluded or ignored are not matched
+	write(".gitignore", "*.txt\n")
+	if out, _ := warnings("excluded", false); !strings.Contains(out, "src/python/*.py of") {
+		t.Error("expected a warning for a glob matching only excluded files, got", out)
+	}
+	if out, _ := warnings("ignored", false); !strings.Contains(out, "*.txt of") {
+		t.Error("expected a warning for a glob matching only ignored files, got", out)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	mf := `
+all: src/python/** !src/python/lib
+	echo a
+raw: +src/python/**
+	echo raw
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	write(".gitignore", "*.pyc\n")
+	expect(t, "all", "a")
+	write("src/python/lib/lib.py")
+	expect(t, "all", "")
+	write("src/python/a.py")
+	expect(t, "all", "a")
+
+	// ignored unless prefixed with +
+	expect(t, "raw", "raw")
+	write("src/python/a.pyc")
+	expect(t, "all", "")
+	expect(t, "raw", "raw")
+}
+
+func TestCycle(t *testing.T) {
+	mf := `
+all: a
+	echo all
+a: b
+	echo a
+b: a
+	echo b
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	_, _, err := runBuild(store, Options{}, "all")
+	if err == nil || !strings.Contains(err.Error(), "a@") || !strings.Contains(err.Error(), " -> b@") || strings.Contains(err.Error(), "all@") {
+		t.Error("expected the cycle to be reported, got", err)
+	}
+	if _, _, err := runBuild(store, Options{}, ""); err == nil {
+		t.Error("expected an error for an empty target name")
+	}
+}
@@ -2,13 +2,19 @@ package mbs
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/juju/errgo"
+	"github.com/vron/mbs/stat"
 )
 
 func (b *Builder) visitTarget(makefile string, target string) (*target, error) {
+	if target == "" {
+		return nil, errors.New("no target given in " + makefile)
+	}
 	if b.targets[targetName(makefile, target)] == nil {
 		err := b.loadMakefile(makefile)
 		if err != nil {
@@ -16,18 +22,30 @@ func (b *Builder) visitTarget(makefile string, target string) (*target, error) {
 		}
 	}
 	if b.targets[targetName(makefile, target)] == nil {
-		panic("no such target in file" + targetName(makefile, target))
-	}
-	if target == "" {
-		// if no target is specified we use the first one
-		panic("not implemented yet")
+		return nil, errors.New("no such target: " + target + " in " + makefile)
 	}
 
 	tgt := b.targets[targetName(makefile, target)]
 	if tgt.mark {
-		panic("import cycle among targets")
+		cycle := []string{}
+		for i := len(b.visiting) - 1; i >= 0; i-- {
+			cycle = append([]string{b.visiting[i].String()}, cycle...)
+			if b.visiting[i] == tgt {
+				break
+			}
+		}
+		return nil, errors.New("import cycle among targets: " + strings.Join(append(cycle, tgt.String()), " -> "))
+	}
+	if tgt.visited {
+		return tgt, nil // allready reached through another path
 	}
 	tgt.mark = true
+	b.visiting = append(b.visiting, tgt)
+	defer func() {
+		tgt.mark = false
+		b.visiting = b.visiting[:len(b.visiting)-1]
+	}()
+	exclude, noIgnore := []string{}, []bool{}
 	for _, d := range tgt.t.Deps {
 		// TOOD: Should we accumulate time here also?
 		if d.Import != "" {
@@ -47,11 +65,24 @@ func (b *Builder) visitTarget(makefile string, target string) (*target, error) {
 			tgt.children = append(tgt.children, dt)
 			dt.parents = append(dt.parents, tgt)
 		} else if d.Filename != "" {
-			tgt.globs = append(tgt.globs, d.Filename)
+			switch d.Filename[0] {
+			case '!':
+				exclude = append(exclude, d.Filename[1:])
+			case '+':
+				tgt.globs = append(tgt.globs, d.Filename[1:])
+				noIgnore = append(noIgnore, true)
+			default:
+				tgt.globs = append(tgt.globs, d.Filename)
+				noIgnore = append(noIgnore, false)
+			}
 		}
 	}
+	// exclusions apply to all globs of the target, wherever they are written
+	for i := range tgt.globs {
+		tgt.filters = append(tgt.filters, stat.Filter{Exclude: exclude, NoIgnore: noIgnore[i]})
+	}
 
-	tgt.mark = false
+	tgt.visited = true
 	return tgt, nil
 }
 
@@ -0,0 +1,68 @@
+package mbs
+
+import (
+	"time"
+)
+
+// An EventType tells what an Event reports.
+type EventType string
+
+// The events reported during a build, in the order they occur for a target.
+const (
+	EventClean    EventType = "clean" // the target and all it depends on are unchanged
+	EventDirty    EventType = "dirty" // the target must be run
+	EventQueued   EventType = "queued"
+	EventStarted  EventType = "started"
+	EventCommand  EventType = "command" // a command of the target is started
+	EventOutput   EventType = "output"  // a chunk of output from the running command
+	EventFinished EventType = "finished"
+)
+
+// An Event reports progress of a build, fields not relevant to the type of
+// event are left empty.
+type Event struct {
+	Type     EventType     `json:"type"`
+	Time     time.Time     `json:"time"`
+	Target   string        `json:"target"`
+	Makefile string        `json:"makefile"`
+	Slot     int           `json:"slot,omitempty"`     // worker slot, for started and later
+	Cmd      string        `json:"cmd,omitempty"`      // for command and output
+	Stream   string        `json:"stream,omitempty"`   // stdout or stderr, for output
+	Data     string        `json:"data,omitempty"`     // for output
+	Code     int           `json:"code,omitempty"`     // exit code, for finished
+	Duration time.Duration `json:"duration,omitempty"` // for finished
+	Err      string        `json:"error,omitempty"`    // for finished
+}
+
+// emit sends e for t to the Events callback if there is one.
+func (b *Builder) emit(t *target, e Event) {
+	if b.Options.Events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Target = t.t.Name
+	e.Makefile = t.makefile
+	b.eventsMu.Lock()
+	b.Options.Events(e)
+	b.eventsMu.Unlock()
+}
+
+// eventWriter emits everything written to it as output events.
+type eventWriter struct {
+	b      *Builder
+	t      *target
+	slot   int
+	cmd    string
+	stream string
+}
+
+func (ew *eventWriter) Write(p []byte) (int, error) {
+	ew.b.emit(ew.t, Event{
+		Type:   EventOutput,
+		Slot:   ew.slot,
+		Cmd:    ew.cmd,
+		Stream: ew.stream,
+		Data:   string(p),
+	})
+	return len(p), nil
+}
@@ -0,0 +1,38 @@
+package mbs
+
+import (
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	mf := `
+all: a README
+	echo c
+a: log.txt
+	echo a
+	exit 3
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	events := []Event{}
+	if _, _, err := runBuild(store, Options{Events: func(e Event) { events = append(events, e) }}, "all"); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+
+	got := ""
+	for _, e := range events {
+		got += e.Target + ":" + string(e.Type) + " "
+		if e.Type == EventOutput && e.Data != "a\n" {
+			t.Error("unexpected output", e.Data)
+		}
+		if e.Type == EventFinished && (e.Code != 3 || e.Err == "" || e.Slot != 1) {
+			t.Error("unexpected finish", e)
+		}
+	}
+	expected := "a:dirty all:dirty a:queued a:started a:command a:output a:command a:finished "
+	if got != expected {
+		t.Error("unexpected events", got)
+	}
+}
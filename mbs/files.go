@@ -1,22 +1,79 @@
 package mbs
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
 	"path/filepath"
+	"strings"
 
 	"github.com/vron/mbs/stat"
 )
 
+// checkFiles finds the hashes of the globs of all targets in dag, statting
+// those not known to be fresh in one walk, and marks the targets clean or
+// dirty.
 func (b *Builder) checkFiles(ctx context.Context, dag *target) error {
+	b.batch.Reload() // others may have built since
+	found, err := b.statGlobs(dag)
+	if err != nil {
+		return err
+	}
+	return b.checkTarget(ctx, dag, found)
+}
+
+// statGlobs stats the globs of all targets in dag that are not in b.fresh,
+// returning the results by glob key.
+func (b *Builder) statGlobs(dag *target) (map[string]stat.Result, error) {
+	keys := []string{}
+	globs := []stat.Glob{}
+	seen := map[*target]bool{}
+	var collect func(t *target)
+	collect = func(t *target) {
+		if seen[t] || t.hashes != nil {
+			return
+		}
+		seen[t] = true
+		for _, c := range t.children {
+			collect(c)
+		}
+		for i, g := range t.globs {
+			key := t.globKey(i)
+			if _, ok := b.fresh[key]; ok {
+				continue
+			}
+			keys = append(keys, key)
+			globs = append(globs, stat.Glob{Root: t.path, Pattern: g, Filter: t.filters[i]})
+		}
+	}
+	collect(dag)
+	res, err := b.stater.StatAll(globs)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]stat.Result, len(keys))
+	for i, key := range keys {
+		found[key] = res[i]
+	}
+	return found, nil
+}
+
+func (b *Builder) checkTarget(ctx context.Context, dag *target, found map[string]stat.Result) error {
 	// walk the DAG to check all files to the cache to
 	// set them as clean and dirty etc.
 
 	// note that a non-existing file is not an error.
 
 	// TOOD: Many go-routines to not block on each stat..
+	if dag.hashes != nil {
+		return nil // allready checked through another parent
+	}
 	clean := true
 	for _, c := range dag.children {
-		err := b.checkFiles(ctx, c)
+		err := b.checkTarget(ctx, c, found)
 		if err != nil {
 			return err
 		}
@@ -25,17 +82,124 @@ func (b *Builder) checkFiles(ctx context.Context, dag *target) error {
 		}
 	}
 
-	for _, g := range dag.globs {
-		hash, err := stat.New(false).Stat(dag.path, g)
-		if err != nil {
-			return err
+	dag.hashes = make([][]byte, len(dag.globs))
+	for i, g := range dag.globs {
+		key := dag.globKey(i)
+		f, ok := b.fresh[key]
+		hash := f.hash
+		if !ok {
+			r := found[key]
+			hash = r.Hash
+			if r.N == 0 {
+				b.empty = append(b.empty, emptyGlob{dag, i})
+			}
+			if b.fresh != nil {
+				b.fresh[key] = freshHash{filepath.Join(dag.path, g), hash}
+			}
+		}
+		dag.hashes[i] = hash
+		get := b.batch.Get
+		if b.shared(dag) {
+			get = b.batch.GetShared
 		}
-		changed := b.cache.Set(filepath.Join(dag.path, g), hash)
-		if changed {
+		if !bytes.Equal(get(b.cacheKey(key)), hash) {
 			clean = false
+			b.summary.CacheMisses++
+		} else {
+			b.summary.CacheHits++
 		}
 	}
+	if dag.t != nil {
+		dag.fingerprint = fingerprint(dag)
+	}
+	if dag.t != nil && dag.t.Service && !b.serviceRunning(dag.key()) {
+		clean = false // it must be started
+	}
+	if clean && dag.t != nil && b.outputsMissing(dag) {
+		clean = false // e.g. removed, or clean by what was built elsewhere
+	}
 	dag.clean = clean
+	if dag.t != nil {
+		if clean {
+			b.emit(dag, Event{Type: EventClean})
+		} else {
+			b.emit(dag, Event{Type: EventDirty})
+		}
+	}
 
 	return nil
 }
+
+// fingerprint returns the fingerprint of t, the hashes of its globs and the
+// fingerprints of its children must be known.
+func fingerprint(t *target) []byte {
+	h := sha256.New224()
+	for _, c := range t.t.Cmds {
+		io.WriteString(h, c.Cmd+"\n")
+	}
+	for _, o := range t.t.Outputs {
+		io.WriteString(h, o.Glob+"\n")
+	}
+	for i, g := range t.globs {
+		io.WriteString(h, g+t.filters[i].String()+"\n")
+		h.Write(t.hashes[i])
+	}
+	for _, c := range t.children {
+		h.Write(c.fingerprint)
+	}
+	return h.Sum(nil)
+}
+
+// emptyGlob is a glob of a target that matched no files when checked.
+type emptyGlob struct {
+	t *target
+	i int // index in the globs of t
+}
+
+// checkEmpty warns about, or with StrictGlobs fails on, the globs that
+// matched no files when checked and still do not after the build, since they
+// may be produced by it.
+func (b *Builder) checkEmpty() error {
+	if len(b.empty) == 0 {
+		return nil
+	}
+	globs := make([]stat.Glob, len(b.empty))
+	for i, e := range b.empty {
+		globs[i] = stat.Glob{Root: e.t.path, Pattern: e.t.globs[e.i], Filter: e.t.filters[e.i]}
+	}
+	res, err := b.stater.StatAll(globs)
+	if err != nil {
+		return nil // not known to match nothing
+	}
+	msgs := []string{}
+	for i, e := range b.empty {
+		if res[i].N == 0 {
+			msgs = append(msgs, globs[i].Pattern+" of "+e.t.String()+" matches no files")
+		}
+	}
+	if len(msgs) > 0 && b.Options.StrictGlobs {
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	for _, m := range msgs {
+		fmt.Fprintln(b.Options.Stderr, "warning: "+m)
+	}
+	return nil
+}
+
+// storeFiles writes the hashes found by checkFiles to the cache for all
+// targets that are clean, i.e. that did not fail or were never run.
+func (b *Builder) storeFiles(dag *target) {
+	for _, c := range dag.children {
+		b.storeFiles(c)
+	}
+	if !dag.clean || dag.hashes == nil {
+		return
+	}
+	stage := b.batch.Stage
+	if b.shared(dag) {
+		stage = b.batch.StageShared
+	}
+	for i := range dag.globs {
+		stage(b.cacheKey(dag.globKey(i)), dag.hashes[i])
+	}
+}
@@ -0,0 +1,148 @@
+package mbs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A Graph is an export of the target DAG as it would be built.
+type Graph struct {
+	Targets []GraphTarget `json:"targets"`
+}
+
+// A GraphTarget is a single target in a Graph, Deps refer to the ID of other
+// targets in the same graph.
+type GraphTarget struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Makefile string        `json:"makefile"`
+	Line     int           `json:"line"`
+	Clean    bool          `json:"clean"`
+	Duration time.Duration `json:"duration"` // as recorded for the last run, 0 if unknown
+	Deps     []string      `json:"deps"`
+	Globs    []string      `json:"globs"` // relative to the directory of the makefile
+}
+
+// Graph builds the DAG for targets and reports it together with the state of
+// each target, nothing is run and the cache is not updated.
+func (b *Builder) Graph(ctx context.Context, makefile string, targets []string) (*Graph, error) {
+	makefile, err := filepath.Abs(makefile)
+	if err != nil {
+		return nil, errors.New("error reading makefile: " + err.Error())
+	}
+	if err := b.setRoot(makefile); err != nil {
+		return nil, err
+	}
+	dag, err := b.buildDAG(ctx, makefile, targets)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.checkFiles(ctx, dag); err != nil {
+		return nil, err
+	}
+	g := &Graph{}
+	seen := map[*target]bool{}
+	for _, c := range dag.children {
+		b.addToGraph(g, c, seen)
+	}
+	return g, nil
+}
+
+func (b *Builder) addToGraph(g *Graph, t *target, seen map[*target]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	gt := GraphTarget{
+		ID:       t.key(),
+		Name:     t.t.Name,
+		Makefile: t.makefile,
+		Line:     t.t.Pos.Line,
+		Clean:    t.clean,
+		Deps:     []string{},
+		Globs:    append([]string{}, t.globs...),
+	}
+	gt.Duration, _ = b.batch.Duration(b.cacheKey(t.key()))
+	for _, c := range t.children {
+		gt.Deps = append(gt.Deps, c.key())
+	}
+	g.Targets = append(g.Targets, gt)
+	for _, c := range t.children {
+		b.addToGraph(g, c, seen)
+	}
+}
+
+// WriteJSON writes the graph as an indented JSON document.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	d, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(d, '\n'))
+	return err
+}
+
+// WriteDot writes the graph in the Graphviz DOT language, with one cluster per
+// makefile. Dirty targets are filled.
+func (g *Graph) WriteDot(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("digraph mbs {\n\trankdir=LR;\n\tnode [shape=box];\n")
+
+	clusters := []string{}
+	byMakefile := map[string][]GraphTarget{}
+	for _, t := range g.Targets {
+		if byMakefile[t.Makefile] == nil {
+			clusters = append(clusters, t.Makefile)
+		}
+		byMakefile[t.Makefile] = append(byMakefile[t.Makefile], t)
+	}
+	for i, mf := range clusters {
+		ew.printf("\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", i, strconv.Quote(mf))
+		for _, t := range byMakefile[mf] {
+			label := t.Name
+			if t.Duration > 0 {
+				label += "\n" + t.Duration.Round(time.Millisecond).String()
+			}
+			style := ""
+			if !t.Clean {
+				style = ", style=filled, fillcolor=lightsalmon"
+			}
+			ew.printf("\t\t%s [label=%s%s];\n", strconv.Quote(t.ID), strconv.Quote(label), style)
+			for _, gl := range t.Globs {
+				id := filepath.Join(filepath.Dir(t.Makefile), gl)
+				ew.printf("\t\t%s [label=%s, shape=note];\n", strconv.Quote(id), strconv.Quote(gl))
+			}
+		}
+		ew.printf("\t}\n")
+	}
+	for _, t := range g.Targets {
+		for _, d := range t.Deps {
+			ew.printf("\t%s -> %s;\n", strconv.Quote(t.ID), strconv.Quote(d))
+		}
+		for _, gl := range t.Globs {
+			id := filepath.Join(filepath.Dir(t.Makefile), gl)
+			ew.printf("\t%s -> %s;\n", strconv.Quote(t.ID), strconv.Quote(id))
+		}
+	}
+	ew.printf("}\n")
+	return ew.err
+}
+
+// errWriter keeps the first error from a sequence of writes.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, a ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, a...)
+}
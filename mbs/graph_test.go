@@ -0,0 +1,62 @@
+package mbs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	mf2 := `
+b: a *.py
+	echo b
+a: lib/lib.py
+	echo a
+`
+	mf1 := `
+import "src/python" as py
+all: py.b py.a log.txt
+	echo c
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf1)
+	write("src/python/Makefile", mf2)
+	expect(t, "all", "abc")
+	write("src/python/a.py")
+
+	g, err := NewBuilder(store, Options{}).Graph(context.Background(), "test/data/Makefile", []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Targets) != 3 {
+		t.Fatal("expected 3 targets but got", len(g.Targets))
+	}
+	clean := map[string]bool{}
+	for _, gt := range g.Targets {
+		clean[gt.Name] = gt.Clean
+	}
+	if clean["all"] || clean["b"] || !clean["a"] {
+		t.Error("bad clean state", clean)
+	}
+	if len(g.Targets[0].Deps) != 2 || len(g.Targets[0].Globs) != 1 {
+		t.Error("bad dependencies of all", g.Targets[0])
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := g.WriteDot(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "digraph") || strings.Count(buf.String(), "->") != 6 {
+		t.Error("unexpected dot output", buf.String())
+	}
+
+	// the graph must not have updated the cache
+	expect(t, "all", "bc")
+
+	_, err = NewBuilder(store, Options{}).Graph(context.Background(), "test/data/Makefile", []string{"nope"})
+	if err == nil || !strings.Contains(err.Error(), "no such target: nope") {
+		t.Error("expected an error for an unknown target", err)
+	}
+}
@@ -0,0 +1,82 @@
+package mbs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the results as a JUnit XML report with one test suite per
+// makefile. Targets that were not run are reported as skipped.
+func (s Summary) WriteJUnit(w io.Writer) error {
+	report := junitSuites{}
+	suites := map[string]int{}
+	for _, r := range s.Results {
+		i, ok := suites[r.Makefile]
+		if !ok {
+			i = len(report.Suites)
+			suites[r.Makefile] = i
+			report.Suites = append(report.Suites, junitSuite{Name: r.Makefile})
+		}
+		suite := &report.Suites[i]
+		c := junitCase{
+			Name:      r.Name,
+			Classname: r.Makefile,
+			Time:      r.Duration.Seconds(),
+			SystemErr: string(r.Stderr),
+		}
+		switch r.State {
+		case ResultClean, ResultNotRun:
+			c.Skipped = &junitMessage{Message: r.State}
+			suite.Skipped++
+		case ResultFailed:
+			c.Failure = &junitMessage{
+				Message: fmt.Sprintf("exit code %d: %s", r.Code, r.Err),
+				Body:    string(r.Stderr),
+			}
+			suite.Failures++
+		}
+		suite.Tests++
+		suite.Time += c.Time
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
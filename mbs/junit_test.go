@@ -0,0 +1,57 @@
+package mbs
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+)
+
+func TestJUnit(t *testing.T) {
+	mf1 := `
+import "src/python" as py
+all: py.a py.b
+	echo c
+first: py.a
+`
+	mf2 := `
+a: *.py
+	echo a
+b: lib/lib.py
+	echo oops >&2
+	exit 2
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf1)
+	write("src/python/Makefile", mf2)
+	expect(t, "first", "a")
+
+	_, b, err := runBuild(store, Options{}, "all")
+	if err == nil {
+		t.Fatal("expected the build to fail")
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := b.Summary().WriteJUnit(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var report junitSuites
+	if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Suites) != 2 {
+		t.Fatal("expected a suite per makefile", buf.String())
+	}
+	all, py := report.Suites[0], report.Suites[1]
+	if all.Tests != 1 || all.Skipped != 1 || all.Cases[0].Skipped.Message != ResultNotRun {
+		t.Error("expected all to be skipped", all)
+	}
+	if py.Tests != 2 || py.Failures != 1 || py.Skipped != 1 {
+		t.Error("expected one failure and one skipped", py)
+	}
+	for _, c := range py.Cases {
+		if c.Name == "b" && (c.Failure == nil || c.Failure.Body != "oops\n") {
+			t.Error("expected b to fail with its stderr", c)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package mbs
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setpgid makes cmd run in its own process group so that everything it
+// starts can be signaled.
+func setpgid(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func terminate(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func kill(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
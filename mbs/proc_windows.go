@@ -0,0 +1,13 @@
+package mbs
+
+import "os/exec"
+
+func setpgid(cmd *exec.Cmd) {}
+
+func terminate(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+func kill(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,198 @@
+package mbs
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/vron/mbs/stat"
+)
+
+// TargetInfo describes a target as declared in a makefile.
+type TargetInfo struct {
+	ID       string // unique among all makefiles
+	Name     string // as referred to from the root makefile, e.g. py.b
+	Makefile string
+	Line     int
+	Doc      string // the comment lines immediately preceding the target
+}
+
+// List returns all the targets reachable from makefile through imports, with
+// targets of the same makefile in declaration order.
+func (b *Builder) List(makefile string) ([]TargetInfo, error) {
+	makefile, err := filepath.Abs(makefile)
+	if err != nil {
+		return nil, errors.New("error reading makefile: " + err.Error())
+	}
+	infos := []TargetInfo{}
+	return infos, b.listMakefile(filepath.Clean(makefile), "", &infos, map[string]bool{})
+}
+
+func (b *Builder) listMakefile(path, prefix string, infos *[]TargetInfo, seen map[string]bool) error {
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+	m, err := b.makefile(path)
+	if err != nil {
+		return err
+	}
+
+	start := len(*infos)
+	for nm, t := range m.Targets {
+		*infos = append(*infos, TargetInfo{
+			ID:       targetName(path, nm),
+			Name:     prefix + nm,
+			Makefile: path,
+			Line:     t.Pos.Line,
+			Doc:      t.Doc,
+		})
+	}
+	own := (*infos)[start:]
+	sort.Slice(own, func(i, j int) bool { return own[i].Line < own[j].Line })
+
+	names := []string{}
+	for nm := range m.Imports {
+		names = append(names, nm)
+	}
+	sort.Strings(names)
+	for _, nm := range names {
+		err := b.listMakefile(resolveImport(path, m.Imports[nm].Path), prefix+nm+".", infos, seen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RDeps returns the targets that directly or indirectly depend on file
+// through one of their globs.
+func (b *Builder) RDeps(makefile string, file string) ([]TargetInfo, error) {
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := b.List(makefile)
+	if err != nil {
+		return nil, err
+	}
+	found := map[*target]bool{}
+	for _, info := range infos {
+		t, err := b.visitTarget(info.Makefile, b.targets[info.ID].t.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range t.globs {
+			if ok, _ := doublestar.Match(filepath.Join(t.path, g), file); ok {
+				markParents(t, found)
+				break
+			}
+		}
+	}
+	res := []TargetInfo{}
+	for _, info := range infos {
+		if found[b.targets[info.ID]] {
+			res = append(res, info)
+		}
+	}
+	return res, nil
+}
+
+func markParents(t *target, found map[*target]bool) {
+	if found[t] {
+		return
+	}
+	found[t] = true
+	for _, p := range t.parents {
+		markParents(p, found)
+	}
+}
+
+// CacheKeys returns the keys of the cache entries used by the targets
+// reachable from makefile through imports, with the names of the targets
+// using each.
+func (b *Builder) CacheKeys(makefile string) (map[string][]string, error) {
+	infos, err := b.List(makefile)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setRoot(makefile); err != nil {
+		return nil, err
+	}
+	keys := map[string][]string{}
+	for _, info := range infos {
+		t, err := b.visitTarget(info.Makefile, b.targets[info.ID].t.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range b.cacheKeys(t) {
+			keys[k] = append(keys[k], info.Name)
+		}
+	}
+	return keys, nil
+}
+
+// TargetCacheKeys returns the keys of the cache entries of the target named
+// as by List, not including those of its dependencies.
+func (b *Builder) TargetCacheKeys(makefile, name string) (map[string]bool, error) {
+	infos, err := b.List(makefile)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setRoot(makefile); err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Name != name {
+			continue
+		}
+		t, err := b.visitTarget(info.Makefile, b.targets[info.ID].t.Name)
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]bool{}
+		for _, k := range b.cacheKeys(t) {
+			keys[k] = true
+		}
+		return keys, nil
+	}
+	return nil, errors.New("no such target: " + name)
+}
+
+// KeyFiles returns the files that the glob with the cache key key matches now,
+// nil if key is not that of a glob of the targets reachable from makefile.
+func (b *Builder) KeyFiles(makefile, key string) ([]string, error) {
+	infos, err := b.List(makefile)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setRoot(makefile); err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		t, err := b.visitTarget(info.Makefile, b.targets[info.ID].t.Name)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range t.globs {
+			if b.cacheKey(t.globKey(i)) != key {
+				continue
+			}
+			res, err := b.stater.StatAll([]stat.Glob{{Root: t.path, Pattern: g, Filter: t.filters[i]}})
+			if err != nil {
+				return nil, err
+			}
+			return res[0].Files, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *Builder) cacheKeys(t *target) []string {
+	keys := []string{b.cacheKey(t.key())}
+	for i := range t.globs {
+		keys = append(keys, b.cacheKey(t.globKey(i)))
+	}
+	return keys
+}
@@ -0,0 +1,95 @@
+package mbs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	mf2 := `
+# b builds
+# everything
+b: a *.py
+	echo b
+
+a: lib/lib.py
+	echo a
+`
+	mf1 := `
+import "src/python" as py
+all: py.b log.txt
+	echo c
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf1)
+	write("src/python/Makefile", mf2)
+
+	infos, err := NewBuilder(store, Options{}).List("test/data/Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := ""
+	for _, info := range infos {
+		names += info.Name + " "
+	}
+	if names != "all py.b py.a " {
+		t.Error("unexpected targets", names)
+	}
+	if infos[1].Doc != "b builds\neverything" || infos[2].Doc != "" {
+		t.Error("unexpected docs", infos)
+	}
+
+	infos, err = NewBuilder(store, Options{}).RDeps("test/data/Makefile", "test/data/src/python/lib/lib.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Error("expected all targets to depend on lib.py", infos)
+	}
+	infos, err = NewBuilder(store, Options{}).RDeps("test/data/Makefile", "test/data/src/python/a.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "all" || infos[1].Name != "py.b" {
+		t.Error("expected all and py.b to depend on a.py", infos)
+	}
+
+	keys, err := NewBuilder(store, Options{}).CacheKeys("test/data/Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// relative to the directory of the makefile as there is no root marker
+	for _, k := range []string{"src/python/*.py", "src/python/lib/lib.py", "src/python/Makefile:a"} {
+		if keys[k] == nil {
+			t.Error("expected key", k, "in", keys)
+		}
+	}
+	if len(keys) != 6 {
+		t.Error("expected 3 targets and 3 globs, got", keys)
+	}
+	if users := keys["src/python/lib/lib.py"]; len(users) != 1 || users[0] != "py.a" {
+		t.Error("expected lib.py to be used by py.a, got", users)
+	}
+	tkeys, err := NewBuilder(store, Options{}).TargetCacheKeys("test/data/Makefile", "py.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tkeys) != 2 || !tkeys["src/python/lib/lib.py"] {
+		t.Error("expected the key of py.a and its glob, got", tkeys)
+	}
+	if _, err = NewBuilder(store, Options{}).TargetCacheKeys("test/data/Makefile", "none"); err == nil {
+		t.Error("expected an error for an unknown target")
+	}
+
+	files, err := NewBuilder(store, Options{}).KeyFiles("test/data/Makefile", "src/python/*.py")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || filepath.Base(files[0]) != "a.py" || filepath.Base(files[1]) != "b.py" {
+		t.Error("expected the files matched by the glob, got", files)
+	}
+	if files, _ = NewBuilder(store, Options{}).KeyFiles("test/data/Makefile", "src/python/Makefile:a"); files != nil {
+		t.Error("expected no files for the key of a target, got", files)
+	}
+}
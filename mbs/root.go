@@ -0,0 +1,61 @@
+package mbs
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// RootMarker is the name of the file marking the root of a project, its first
+// line may name the project so that checkouts in different directories share
+// the cache.
+const RootMarker = ".mbsroot"
+
+// FindRoot returns the root of the project of makefile: the closest directory
+// at or above it holding a RootMarker, or else the directory of makefile. The
+// name of the project is the one in the marker, or else the path of the root,
+// as the names of directories are not unique.
+func FindRoot(makefile string) (root, name string, err error) {
+	path, err := filepath.Abs(makefile)
+	if err != nil {
+		return "", "", errors.New("error reading makefile: " + err.Error())
+	}
+	dir := filepath.Dir(path)
+	for d := dir; ; {
+		if data, err := ioutil.ReadFile(filepath.Join(d, RootMarker)); err == nil {
+			name = strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+			if name == "" {
+				name = d
+			}
+			return d, name, nil
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	return dir, dir, nil
+}
+
+// setRoot sets the root that cache keys are relative to for makefile.
+func (b *Builder) setRoot(makefile string) (err error) {
+	if b.Options.Root != "" {
+		b.root, err = filepath.Abs(b.Options.Root)
+	} else {
+		b.root, _, err = FindRoot(makefile)
+	}
+	b.stater.Root = b.root // where ignore files apply from
+	return
+}
+
+// cacheKey returns the key in the cache for the absolute path, relative to
+// the root so that the cache is valid for the project in another directory.
+func (b *Builder) cacheKey(path string) string {
+	rel, err := filepath.Rel(b.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
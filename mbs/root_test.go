@@ -0,0 +1,56 @@
+package mbs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindRoot(t *testing.T) {
+	initFs()
+	defer cleanFs()
+	write("sub/Makefile", "")
+	data, _ := filepath.Abs("test/data")
+
+	root, name, err := FindRoot("test/data/sub/Makefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root != filepath.Join(data, "sub") || name != root {
+		t.Error("expected the directory of the makefile without a marker, got", root, name)
+	}
+	write(RootMarker, "")
+	if root, name, _ = FindRoot("test/data/sub/Makefile"); root != data || name != data {
+		t.Error("expected the directory of the marker, got", root, name)
+	}
+	write(RootMarker, "proj\n")
+	if _, name, _ = FindRoot("test/data/sub/Makefile"); name != "proj" {
+		t.Error("expected the name in the marker, got", name)
+	}
+}
+
+func TestMoved(t *testing.T) {
+	mf := `
+all: **/*.py
+	echo a
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	expect(t, "all", "a")
+
+	// the same files in another directory use the same cache
+	if err := os.Rename("test/data", "test/moved"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	b := NewBuilder(store, Options{LogOutput: true, Stdout: buf})
+	if err := b.Build(context.Background(), "test/moved/Makefile", []string{"all"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Error("expected all to be clean after moving, got", buf.String())
+	}
+}
@@ -3,16 +3,22 @@ package mbs
 import (
 	"bytes"
 	"context"
+	"io"
 	"os/exec"
+	"time"
 )
 
 // TODO: Set the priority so stuff with many dependicies are started first
 
+// maxWorkers is the number of targets that are run in parallel.
+const maxWorkers = 4
+
 type runner struct {
 	b                   *Builder
 	ctx                 context.Context
 	cancel              context.CancelFunc
 	maxWorkers, workers int
+	slots               []bool // slots[i] is true if worker slot i+1 is busy
 	queue               *queue
 	result              chan runResult
 }
@@ -25,7 +31,12 @@ func (r *runner) startMax() {
 		}
 		r.workers++
 
-		go r.runTarget(r.ctx, t, r.result)
+		slot := 0
+		for r.slots[slot] {
+			slot++
+		}
+		r.slots[slot] = true
+		go r.runTarget(r.ctx, t, slot+1, r.result)
 	}
 }
 
@@ -33,7 +44,8 @@ func (b *Builder) doRun(ctx context.Context, dag *target) error {
 	// walk down - get the ones that are not clean and start building.
 	r := &runner{
 		b:          b,
-		maxWorkers: 4,
+		maxWorkers: maxWorkers,
+		slots:      make([]bool, maxWorkers),
 		queue:      newQueue(),
 		result:     make(chan runResult, 100),
 	}
@@ -51,10 +63,13 @@ loop:
 	for {
 		select {
 		case <-r.ctx.Done():
+			if firstErr == nil {
+				firstErr = r.ctx.Err() // cancelled from the outside
+			}
 			break loop
-			panic("unimplemented cancelation handling" + r.ctx.Err().Error())
 		case res := <-r.result:
 			if res.err != nil {
+				b.failed(res)
 				if firstErr == nil {
 					firstErr = res.err
 				}
@@ -65,8 +80,15 @@ loop:
 				// check if this enables any new stuff to be added to the priority
 				// queue and subsequently run.
 				r.workers--
+				r.slots[res.slot-1] = false
 
 				res.t.clean = true
+				if res.restored {
+					b.restored(res)
+				} else {
+					b.batch.StageDuration(b.cacheKey(res.t.key()), res.duration)
+					b.ran(res)
+				}
 				for _, p := range res.t.parents {
 					if p.t == nil {
 						continue // this is the wrapper node that needs no building
@@ -78,7 +100,7 @@ loop:
 						}
 					}
 					if !dirty {
-						r.queue.Insert(p)
+						r.enqueue(p)
 					}
 				}
 				r.startMax()
@@ -117,52 +139,111 @@ func (r *runner) findStart(dag *target, q *queue) {
 		}
 	}
 	if doRun {
-		q.Insert(dag)
+		r.enqueue(dag)
 	}
 }
 
+// enqueue adds t to the queue unless it has allready been added, which
+// happens for targets reached through several paths.
+func (r *runner) enqueue(t *target) {
+	if t.queued {
+		return
+	}
+	t.queued = true
+	r.queue.Insert(t)
+	r.b.emit(t, Event{Type: EventQueued})
+}
+
 type runResult struct {
 	t      *target
 	stdout []byte
 	stderr []byte
 
-	done bool
-	code int
-	err  error
+	done     bool
+	restored bool // the outputs were restored instead of running the commands
+	code     int
+	err      error
+	slot     int           // the worker slot the target was run in
+	duration time.Duration // time since the first command of the target started
 }
 
-func (rr *runner) runTarget(ctx context.Context, t *target, ch chan runResult) {
+func (rr *runner) runTarget(ctx context.Context, t *target, slot int, ch chan runResult) {
 	// All commands in a target are run sequentially
 	// TODO: Introduce flag if we should keep the stdout/err or not, depending on
 	// command they could becode expensive? (or only log those with bad exit signals?)
-	for i, c := range t.t.Cmds {
+	start := time.Now()
+	tr := rr.b.tracer
+	rr.b.emit(t, Event{Type: EventStarted, Slot: slot})
+	send := func(r runResult) {
+		if r.done {
+			tr.span("target", t.t.Name, slot, start, map[string]interface{}{"makefile": t.makefile})
+			e := Event{Type: EventFinished, Slot: slot, Code: r.code, Duration: time.Since(start)}
+			if r.err != nil {
+				e.Err = r.err.Error()
+			}
+			rr.b.emit(t, e)
+		}
+		ch <- r
+	}
+	if len(t.t.Cmds) == 0 {
+		send(runResult{t: t, slot: slot, done: true})
+		return
+	}
+	if rr.b.restoreOutputs(t) {
+		send(runResult{t: t, slot: slot, done: true, restored: true, duration: time.Since(start)})
+		return
+	}
+	cmds := t.t.Cmds
+	if t.t.Service {
+		cmds = cmds[:len(cmds)-1] // the last one is started separately
+	}
+	stderr := bytes.NewBuffer(nil) // kept for all commands of the target
+	for i, c := range cmds {
 		cmd := exec.CommandContext(ctx, "bash", "-c", c.Cmd)
 		stdout := bytes.NewBuffer(nil)
-		stderr := bytes.NewBuffer(nil)
 		cmd.Stdout = stdout
 		cmd.Stderr = stderr
+		if rr.b.Options.Events != nil {
+			cmd.Stdout = io.MultiWriter(stdout, &eventWriter{rr.b, t, slot, c.Cmd, "stdout"})
+			cmd.Stderr = io.MultiWriter(stderr, &eventWriter{rr.b, t, slot, c.Cmd, "stderr"})
+		}
+		rr.b.emit(t, Event{Type: EventCommand, Slot: slot, Cmd: c.Cmd})
+		cstart := time.Now()
 		err := cmd.Run()
+		tr.span("cmd", c.Cmd, slot, cstart, nil)
 		r := runResult{
 			t:      t,
 			stdout: stdout.Bytes(),
 			stderr: stderr.Bytes(),
 			err:    err,
+			slot:   slot,
 		}
+		r.duration = time.Since(start)
 		if i >= len(t.t.Cmds)-1 {
 			r.done = true // the last one, so this command is done, signal that.
 		}
 		if e, ok := err.(*exec.ExitError); ok {
 			r.code = e.ExitCode()
-			if r.code != 0 {
-				// we abort as soon as we get a non - zero code...
-				r.done = true
-				ch <- r
-				return
-			}
+		}
+		if err != nil {
+			// we abort as soon as we get a non - zero code...
+			r.done = true
+			send(r)
+			return
 		}
 
 		rr.b.logCommandOutput(stdout.Bytes())
 
-		ch <- r
+		if r.done {
+			rr.b.storeOutputs(t)
+		}
+		send(r)
+	}
+
+	if t.t.Service {
+		c := t.t.Cmds[len(t.t.Cmds)-1]
+		rr.b.emit(t, Event{Type: EventCommand, Slot: slot, Cmd: c.Cmd})
+		err := rr.b.startService(ctx, t, slot, c)
+		send(runResult{t: t, stderr: stderr.Bytes(), err: err, slot: slot, done: true, duration: time.Since(start)})
 	}
 }
@@ -0,0 +1,173 @@
+package mbs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/vron/mbs/conf"
+)
+
+// serviceTimeout is how long a service may take to become ready.
+var serviceTimeout = time.Minute
+
+// serviceStopTimeout is how long a service is given to exit before it is
+// killed.
+var serviceStopTimeout = 5 * time.Second
+
+// A service is the running last command of a service target.
+type service struct {
+	name   string
+	cmd    *exec.Cmd
+	exited chan struct{}
+	err    error // why the command exited, set before exited is closed
+}
+
+// startService starts the command c of t in the background, replacing any
+// earlier instance of it, and waits for it to become ready.
+func (b *Builder) startService(ctx context.Context, t *target, slot int, c conf.Command) error {
+	b.stopService(t.key())
+
+	cmd := exec.Command("bash", "-c", c.Cmd)
+	setpgid(cmd)
+	var stdout, stderr io.Writer = ioutil.Discard, ioutil.Discard
+	if b.Options.LogOutput {
+		stdout, stderr = b.Options.Stdout, b.Options.Stderr
+	}
+	if b.Options.Events != nil {
+		stdout = io.MultiWriter(stdout, &eventWriter{b, t, slot, c.Cmd, "stdout"})
+		stderr = io.MultiWriter(stderr, &eventWriter{b, t, slot, c.Cmd, "stderr"})
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s := &service{name: t.t.Name, cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		s.err = cmd.Wait()
+		close(s.exited)
+	}()
+	b.servicesMu.Lock()
+	b.services[t.key()] = s
+	b.servicesMu.Unlock()
+
+	if err := s.waitReady(ctx, t.t.Ready); err != nil {
+		b.stopService(t.key())
+		return err
+	}
+	return nil
+}
+
+func (s *service) waitReady(ctx context.Context, ready *conf.Ready) error {
+	if ready == nil {
+		return nil
+	}
+	deadline := time.NewTimer(serviceTimeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if isReady(ctx, ready) {
+			return nil
+		}
+		select {
+		case <-s.exited:
+			return errors.New("service " + s.name + " exited before it was ready: " + errString(s.err))
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return errors.New("service " + s.name + " not ready after " + serviceTimeout.String())
+		case <-tick.C:
+		}
+	}
+}
+
+func isReady(ctx context.Context, ready *conf.Ready) bool {
+	if ready.Addr != "" {
+		conn, err := net.DialTimeout("tcp", ready.Addr, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	return exec.CommandContext(ctx, "bash", "-c", ready.Cmd).Run() == nil
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// serviceRunning tells if the service of the target with key is running.
+func (b *Builder) serviceRunning(key string) bool {
+	b.servicesMu.Lock()
+	s := b.services[key]
+	b.servicesMu.Unlock()
+	return s != nil && s.running()
+}
+
+func (s *service) running() bool {
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// Services returns the names of the services that are running.
+func (b *Builder) Services() []string {
+	b.servicesMu.Lock()
+	services := make([]*service, 0, len(b.services))
+	for _, s := range b.services {
+		services = append(services, s)
+	}
+	b.servicesMu.Unlock()
+	names := []string{}
+	for _, s := range services {
+		if s.running() {
+			names = append(names, s.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StopServices stops all running services, they are first asked to
+// terminate and then killed.
+func (b *Builder) StopServices() {
+	b.servicesMu.Lock()
+	keys := make([]string, 0, len(b.services))
+	for k := range b.services {
+		keys = append(keys, k)
+	}
+	b.servicesMu.Unlock()
+	for _, k := range keys {
+		b.stopService(k)
+	}
+}
+
+func (b *Builder) stopService(key string) {
+	b.servicesMu.Lock()
+	s := b.services[key]
+	delete(b.services, key)
+	b.servicesMu.Unlock()
+	if s == nil {
+		return
+	}
+	terminate(s.cmd)
+	select {
+	case <-s.exited:
+	case <-time.After(serviceStopTimeout):
+		kill(s.cmd)
+		<-s.exited
+	}
+}
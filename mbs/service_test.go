@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package mbs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestService(t *testing.T) {
+	mf := `
+service web: log.txt
+	echo setup
+	@ready test -f test/up
+	touch test/up; exec sleep 60
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	out := &syncBuffer{}
+	b := NewBuilder(store, Options{LogOutput: true, Stdout: out})
+	defer b.StopServices()
+
+	// only output of the commands before the service is checked as that of the
+	// service may still be on its way when the build is done
+	build := func(expected string) {
+		if err := b.Build(context.Background(), "test/data/Makefile", []string{"web"}); err != nil {
+			t.Fatal(err)
+		}
+		if o := out.take(); o != expected {
+			t.Error("output not matching", "'"+o+"'", "!=", "'"+expected+"'")
+		}
+	}
+
+	build("setup")
+	if _, err := os.Stat("test/up"); err != nil {
+		t.Error("service not ready:", err)
+	}
+	if s := b.Services(); len(s) != 1 || s[0] != "web" {
+		t.Error("expected web to be running, got", s)
+	}
+	build("") // allready running and clean
+	os.Remove("test/up")
+	write("log.txt")
+	build("setup") // restarted
+
+	b.StopServices()
+	if s := b.Services(); len(s) != 0 {
+		t.Error("expected no running services, got", s)
+	}
+	build("setup") // started again
+}
+
+func TestServiceExits(t *testing.T) {
+	mf := `
+service web:
+	@ready false
+	exit 3
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	_, b, err := runBuild(store, Options{Stderr: &bytes.Buffer{}}, "web")
+	defer b.StopServices()
+	if err == nil || !strings.Contains(err.Error(), "exited before it was ready") {
+		t.Error("expected service to fail, got", err)
+	}
+}
@@ -0,0 +1,158 @@
+package mbs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxSlowest is the number of targets reported in Summary.Slowest.
+const maxSlowest = 5
+
+// A Summary reports what happened during the last call to Build.
+type Summary struct {
+	Measures
+
+	Considered int // number of targets in the DAG
+	Clean      int // targets that did not need to be run
+	Run        int // targets that were run successfully
+	Restored   int // targets with outputs restored from the artifact store
+	Failed     int
+
+	// Slowest holds the slowest targets that were run, slowest first.
+	Slowest []TargetTime
+	// Results holds the outcome for each target of the DAG.
+	Results []TargetResult
+
+	FilesStated int
+	CacheHits   int // globs for which the files were unchanged
+	CacheMisses int
+}
+
+// A TargetTime is the time it took to run a target.
+type TargetTime struct {
+	Name     string
+	Makefile string
+	Duration time.Duration
+}
+
+// The possible states of a TargetResult.
+const (
+	ResultClean    = "clean"
+	ResultRun      = "run"
+	ResultRestored = "restored"
+	ResultFailed   = "failed"
+	ResultNotRun   = "not run" // dirty but not run since the build failed
+)
+
+// A TargetResult is the outcome of a single target in a build.
+type TargetResult struct {
+	Name     string
+	Makefile string
+	State    string
+	Duration time.Duration
+	Code     int    // exit code of the failing command
+	Err      string // why the target failed
+	Stderr   []byte // stderr of all commands that were run
+}
+
+// Summary returns the summary of the last build.
+func (b *Builder) Summary() Summary {
+	return b.summary
+}
+
+// HitRatio is the fraction of globs that were found unchanged, 1 if there
+// were no globs.
+func (s Summary) HitRatio() float64 {
+	if s.CacheHits+s.CacheMisses == 0 {
+		return 1
+	}
+	return float64(s.CacheHits) / float64(s.CacheHits+s.CacheMisses)
+}
+
+func (s Summary) String() string {
+	sb := &strings.Builder{}
+	fmt.Fprintf(sb, "%d targets: %d clean, %d run, %d failed", s.Considered, s.Clean, s.Run, s.Failed)
+	if s.Restored > 0 {
+		fmt.Fprintf(sb, ", %d restored", s.Restored)
+	}
+	sb.WriteString("\n")
+	fmt.Fprintf(sb, "time: graph %v (parse %v), stat %v, run %v\n",
+		round(s.TimeGraph), round(s.TimeParse), round(s.TimeStat), round(s.TimeRun))
+	fmt.Fprintf(sb, "cache: %d files stated, %.0f%% hits (%d of %d globs)\n",
+		s.FilesStated, 100*s.HitRatio(), s.CacheHits, s.CacheHits+s.CacheMisses)
+	if len(s.Slowest) > 0 {
+		sb.WriteString("slowest:")
+		for _, t := range s.Slowest {
+			fmt.Fprintf(sb, " %s %v,", t.Name, round(t.Duration))
+		}
+		return strings.TrimSuffix(sb.String(), ",") + "\n"
+	}
+	return sb.String()
+}
+
+func round(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(10 * time.Microsecond)
+}
+
+// countTargets counts the targets of the DAG and the ones that are clean,
+// adding a result for each.
+func (b *Builder) countTargets(t *target, seen map[*target]int) {
+	for _, c := range t.children {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = len(b.summary.Results)
+		res := TargetResult{Name: c.t.Name, Makefile: c.makefile, State: ResultNotRun}
+		b.summary.Considered++
+		if c.clean {
+			b.summary.Clean++
+			res.State = ResultClean
+		}
+		b.summary.Results = append(b.summary.Results, res)
+		b.countTargets(c, seen)
+	}
+}
+
+// ran records that the target of res was successfully run.
+func (b *Builder) ran(res runResult) {
+	s := &b.summary
+	s.Run++
+	s.Slowest = append(s.Slowest, TargetTime{Name: res.t.t.Name, Makefile: res.t.makefile, Duration: res.duration})
+	sort.Slice(s.Slowest, func(i, j int) bool { return s.Slowest[i].Duration > s.Slowest[j].Duration })
+	if len(s.Slowest) > maxSlowest {
+		s.Slowest = s.Slowest[:maxSlowest]
+	}
+	b.setResult(ResultRun, res)
+}
+
+// restored records that the outputs of the target of res were restored.
+func (b *Builder) restored(res runResult) {
+	b.summary.Restored++
+	b.setResult(ResultRestored, res)
+}
+
+// failed records that the target of res failed.
+func (b *Builder) failed(res runResult) {
+	b.summary.Failed++
+	b.setResult(ResultFailed, res)
+}
+
+func (b *Builder) setResult(state string, res runResult) {
+	i, ok := b.resultIdx[res.t]
+	if !ok {
+		return
+	}
+	r := &b.summary.Results[i]
+	r.State = state
+	r.Duration = res.duration
+	r.Code = res.code
+	r.Stderr = res.stderr
+	if res.err != nil {
+		r.Err = res.err.Error()
+	}
+}
@@ -0,0 +1,42 @@
+package mbs
+
+import (
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	mf := `
+all: a b
+	echo all
+a: src/python/*.py
+	echo a
+b: README log.txt
+	echo b
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	_, b, err := runBuild(store, Options{}, "all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Summary(); s.Considered != 3 || s.Clean != 0 || s.Run != 3 {
+		t.Error("bad target counts", s)
+	}
+
+	write("README")
+	if _, b, err = runBuild(store, Options{}, "all"); err != nil {
+		t.Fatal(err)
+	}
+	s := b.Summary()
+	if s.Considered != 3 || s.Clean != 1 || s.Run != 2 || s.Failed != 0 {
+		t.Error("bad target counts", s)
+	}
+	if s.CacheHits != 2 || s.CacheMisses != 1 || s.FilesStated != 4 {
+		t.Error("bad file counts", s)
+	}
+	if len(s.Slowest) != 2 || s.TimeRun < s.Slowest[0].Duration {
+		t.Error("bad timing", s)
+	}
+}
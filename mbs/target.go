@@ -4,13 +4,17 @@ import (
 	"bufio"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/vron/mbs/conf"
+	"github.com/vron/mbs/stat"
 )
 
 type target struct {
-	mark  bool // mark used to look for import cycles
-	clean bool
+	mark    bool // mark used to look for import cycles
+	visited bool // set once the dependencies have been resolved
+	queued  bool // set once added to the run queue
+	clean   bool
 
 	t *conf.Target
 	i map[string]*conf.Import
@@ -20,8 +24,15 @@ type target struct {
 	parents   []*target
 	children  []*target
 
-	path  string
-	globs []string
+	makefile string
+	path     string
+	globs    []string
+	filters  []stat.Filter // of each glob
+	hashes   [][]byte      // hash of each glob as found by checkFiles
+
+	// fingerprint identifies the commands and inputs of the target and all it
+	// depends on, set by checkFiles.
+	fingerprint []byte
 }
 
 func (t *target) String() string {
@@ -31,20 +42,29 @@ func (t *target) String() string {
 	return t.t.Name + "@" + t.path
 }
 
+// globKey identifies glob i of t, with its filter, across builds.
+func (t *target) globKey(i int) string {
+	return filepath.Join(t.path, t.globs[i]) + t.filters[i].String()
+}
+
+// key identifies the target across builds.
+func (t *target) key() string {
+	return targetName(t.makefile, t.t.Name)
+}
+
 func (b *Builder) loadMakefile(path string) error {
 	// load the makefile and turn it into target structures that we need
 	if !filepath.IsAbs(path) {
 		panic("invariant broken")
 	}
 	folder := filepath.Dir(path)
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	reader := bufio.NewReader(f)
-	m, err := conf.Parse(reader)
-	if err != nil {
-		return err
+	m := b.makefiles[path]
+	if m == nil {
+		var err error
+		if m, err = b.parseMakefile(path); err != nil {
+			return err
+		}
+		b.makefiles[path] = m
 	}
 
 	for nm, tg := range m.Targets {
@@ -54,8 +74,33 @@ func (b *Builder) loadMakefile(path string) error {
 			parents:  []*target{},
 			children: []*target{},
 			globs:    []string{},
+			makefile: path,
 			path:     folder,
 		}
 	}
 	return nil
 }
+
+func (b *Builder) parseMakefile(path string) (*conf.Makefile, error) {
+	start := time.Now()
+	defer func() {
+		b.summary.TimeParse += time.Since(start)
+		b.tracer.span("parse", path, 0, start, nil)
+	}()
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return conf.Parse(bufio.NewReader(f))
+}
+
+// makefile returns the parsed makefile at path, loading it if needed.
+func (b *Builder) makefile(path string) (*conf.Makefile, error) {
+	if b.makefiles[path] == nil {
+		if err := b.loadMakefile(path); err != nil {
+			return nil, err
+		}
+	}
+	return b.makefiles[path], nil
+}
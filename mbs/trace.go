@@ -0,0 +1,99 @@
+package mbs
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// traceEvent is an event in the Chrome trace event format, see
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type traceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"` // in µs since the start of the build
+	Dur  int64                  `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// A tracer collects the timeline of a build, all methods are safe to call on
+// a nil tracer in which case nothing is recorded. Tid 0 is used for the phases
+// of the build and tid n for worker slot n.
+type tracer struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []traceEvent
+}
+
+func newTracer() *tracer {
+	return &tracer{
+		start:  time.Now(),
+		events: make([]traceEvent, 0, 100),
+	}
+}
+
+// span records that name took place on tid between start and now.
+func (tr *tracer) span(cat, name string, tid int, start time.Time, args map[string]interface{}) {
+	if tr == nil {
+		return
+	}
+	now := time.Now()
+	tr.mu.Lock()
+	tr.events = append(tr.events, traceEvent{
+		Name: name,
+		Cat:  cat,
+		Ph:   "X",
+		Ts:   int64(start.Sub(tr.start) / time.Microsecond),
+		Dur:  int64(now.Sub(start) / time.Microsecond),
+		Tid:  tid,
+		Args: args,
+	})
+	tr.mu.Unlock()
+}
+
+// rewritable is a writer that write starts over, such as an *os.File.
+type rewritable interface {
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// write writes all events recorded so far as a JSON trace, naming the threads
+// used by the workers. A rewritable w is emptied first, so that it holds one
+// trace.
+func (tr *tracer) write(w io.Writer, workers int) error {
+	if tr == nil {
+		return nil
+	}
+	if r, ok := w.(rewritable); ok {
+		if err := r.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	events := make([]traceEvent, 0, len(tr.events)+workers+1)
+	for i := 0; i <= workers; i++ {
+		name := "worker " + strconv.Itoa(i)
+		if i == 0 {
+			name = "mbs"
+		}
+		events = append(events, traceEvent{
+			Name: "thread_name",
+			Ph:   "M",
+			Tid:  i,
+			Args: map[string]interface{}{"name": name},
+		})
+	}
+	events = append(events, tr.events...)
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}{events})
+}
@@ -0,0 +1,87 @@
+package mbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	mf := `
+all: a b
+	echo all
+a: README
+	echo a
+b: log.txt
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	buf := bytes.NewBuffer(nil)
+	if _, _, err := runBuild(store, Options{Trace: buf}, "all"); err != nil {
+		t.Fatal(err)
+	}
+
+	var trace struct {
+		TraceEvents []traceEvent
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]int{}
+	for _, e := range trace.TraceEvents {
+		found[e.Cat+":"+e.Name] = e.Tid
+	}
+	for _, n := range []string{"phase:dag", "phase:stat", "phase:run", "target:all", "target:a", "target:b", "cmd:echo a"} {
+		if _, ok := found[n]; !ok {
+			t.Error("missing event", n)
+		}
+	}
+	if found["target:all"] < 1 || found["target:all"] > maxWorkers {
+		t.Error("target not run in a worker slot", found["target:all"])
+	}
+}
+
+func TestTraceRewritten(t *testing.T) {
+	mf := `
+a: README
+	echo a
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+	f, err := os.Create("test/trace.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// as when watching, the file holds the trace of the last build
+	for i := 0; i < 2; i++ {
+		if _, _, err := runBuild(store, Options{Trace: f}, "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile("test/trace.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent
+	}
+	if err := json.Unmarshal(data, &trace); err != nil {
+		t.Fatal("expected one trace, got", err)
+	}
+	n := 0
+	for _, e := range trace.TraceEvents {
+		if e.Cat == "phase" && e.Name == "dag" {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Error("expected the events of one build, got", n)
+	}
+}
@@ -0,0 +1,197 @@
+package mbs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// watchDebounce is how long the files must be left alone after a change
+// before a new build is started.
+var watchDebounce = 100 * time.Millisecond
+
+// A change is a file or directory that was created, modified or removed.
+type change struct {
+	path  string
+	isDir bool
+}
+
+// Watch builds targets and then rebuilds them each time the files they
+// depend on change, until ctx is done. If the files change during a build
+// that build is cancelled and a new one started. built is called with the
+// result of each build that was not cancelled.
+func (b *Builder) Watch(ctx context.Context, makefile string, targets []string, built func(error)) error {
+	makefile, err := filepath.Abs(makefile)
+	if err != nil {
+		return errors.New("error reading makefile: " + err.Error())
+	}
+	w, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	b.fresh = map[string]freshHash{}
+	defer func() { b.fresh = nil }()
+
+	var last *watched
+	for {
+		cancelled, pending, err := b.watchBuild(ctx, w, makefile, targets, last)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !cancelled {
+			built(err)
+		}
+
+		last = b.watched()
+		if err := last.add(w); err != nil {
+			return err
+		}
+		changed := false
+		for _, c := range pending {
+			changed = last.affected(c) || changed
+			b.forget(c)
+		}
+		for !changed {
+			select {
+			case c := <-w.changes:
+				changed = last.affected(c)
+				b.forget(c)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		b.debounce(ctx, w)
+	}
+}
+
+// watchBuild runs a build while collecting changes, the build is cancelled as
+// soon as a change affecting last is seen.
+func (b *Builder) watchBuild(ctx context.Context, w *watcher, makefile string, targets []string, last *watched) (cancelled bool, pending []change, err error) {
+	bctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- b.Build(bctx, makefile, targets) }()
+	for {
+		select {
+		case err := <-done:
+			return cancelled, pending, err
+		case c := <-w.changes:
+			// the build is using b.fresh so it is only updated later
+			pending = append(pending, c)
+			if last != nil && last.affected(c) {
+				cancelled = true
+				cancel()
+			}
+		}
+	}
+}
+
+// debounce waits for a burst of changes to end.
+func (b *Builder) debounce(ctx context.Context, w *watcher) {
+	t := time.NewTimer(watchDebounce)
+	defer t.Stop()
+	for {
+		select {
+		case c := <-w.changes:
+			b.forget(c)
+			if !t.Stop() {
+				<-t.C
+			}
+			t.Reset(watchDebounce)
+		case <-t.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// forget drops the known hashes of globs, and parsed makefiles, affected by c.
+func (b *Builder) forget(c change) {
+	delete(b.makefiles, c.path)
+	for key, f := range b.fresh {
+		if affects(c, f.pattern) {
+			delete(b.fresh, key)
+		}
+	}
+}
+
+// freshHash is the known hash of a glob.
+type freshHash struct {
+	pattern string // absolute
+	hash    []byte
+}
+
+// watched is what a build depended on.
+type watched struct {
+	makefiles map[string]bool
+	globs     []string // absolute patterns
+}
+
+func (b *Builder) watched() *watched {
+	w := &watched{makefiles: map[string]bool{}}
+	for path := range b.makefiles {
+		w.makefiles[path] = true
+	}
+	for _, f := range b.fresh {
+		w.globs = append(w.globs, f.pattern)
+	}
+	return w
+}
+
+func (wd *watched) affected(c change) bool {
+	if wd.makefiles[c.path] {
+		return true
+	}
+	for _, g := range wd.globs {
+		if affects(c, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// affects tells if the change could alter what pattern matches.
+func affects(c change, pattern string) bool {
+	if match, _ := doublestar.Match(pattern, c.path); match {
+		return true
+	}
+	// directories may be moved or removed with files inside
+	root, recursive := globRoot(pattern)
+	under := recursive && strings.HasPrefix(c.path, root+string(filepath.Separator))
+	return c.isDir && (under || c.path == root)
+}
+
+// add makes sure all directories that may hold files matched by the globs,
+// and the makefiles, are watched.
+func (wd *watched) add(w *watcher) error {
+	for path := range wd.makefiles {
+		if err := w.add(filepath.Dir(path), false); err != nil {
+			return err
+		}
+	}
+	for _, g := range wd.globs {
+		if err := w.add(globRoot(g)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globRoot returns the directory below which all files matched by the
+// absolute pattern are found, recursive is false if they all are found
+// directly in root.
+func globRoot(pattern string) (root string, recursive bool) {
+	parts := strings.Split(filepath.Dir(pattern), string(filepath.Separator))
+	for i, p := range parts {
+		if strings.ContainsAny(p, "*?[{\\") {
+			return strings.Join(parts[:i], string(filepath.Separator)), true
+		}
+	}
+	return filepath.Dir(pattern), false
+}
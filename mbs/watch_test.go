@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package mbs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for use by the builder and the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func (sb *syncBuffer) take() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	s := strings.Replace(sb.buf.String(), "\n", "", -1)
+	sb.buf.Reset()
+	return s
+}
+
+func TestWatch(t *testing.T) {
+	mf := `
+all: a log.txt
+	echo all
+a: src/**/*.py
+	echo a
+`
+	initFs()
+	defer cleanFs()
+	write("Makefile", mf)
+
+	out := &syncBuffer{}
+	b := NewBuilder(store, Options{LogOutput: true, Stdout: out})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	builds := make(chan error)
+	stopped := make(chan error)
+	go func() {
+		stopped <- b.Watch(ctx, "test/data/Makefile", []string{"all"}, func(err error) { builds <- err })
+	}()
+	next := func(expected string) {
+		select {
+		case err := <-builds:
+			if err != nil {
+				t.Error(err)
+			}
+			if o := out.take(); o != expected {
+				t.Error("output not matching", "'"+o+"'", "!=", "'"+expected+"'")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for build")
+		}
+	}
+
+	next("aall")
+	write("log.txt")
+	next("all")
+	write("src/python/lib/lib.py")
+	next("aall")
+	write("src/python/new/new.py") // in a new directory
+	next("aall")
+	write("README") // not a dependency, should not trigger a build
+	write("log.txt")
+	next("all")
+
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Error("expected watch to stop with canceled but got", err)
+	}
+}
@@ -0,0 +1,169 @@
+package mbs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_ATTRIB |
+	unix.IN_CLOSE_WRITE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// A watcher reports changes to files in the directories added to it, using
+// inotify.
+type watcher struct {
+	changes chan change
+
+	fd   int
+	mu   sync.Mutex
+	dirs map[int]watchedDir // by watch descriptor
+	wds  map[string]int     // by path
+	stop chan struct{}
+	done chan struct{}
+}
+
+type watchedDir struct {
+	path      string
+	recursive bool
+}
+
+func newWatcher() (*watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &watcher{
+		changes: make(chan change, 100),
+		fd:      fd,
+		dirs:    map[int]watchedDir{},
+		wds:     map[string]int{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.read()
+	return w, nil
+}
+
+// add starts watching dir, and all directories below it if recursive.
+// Directories that do not exist are ignored.
+func (w *watcher) add(dir string, recursive bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addLocked(dir, recursive)
+}
+
+func (w *watcher) addLocked(dir string, recursive bool) error {
+	if wd, ok := w.wds[dir]; ok && (w.dirs[wd].recursive || !recursive) {
+		return nil
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, dir, inotifyMask|unix.IN_ONLYDIR)
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		return nil
+	} else if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.dirs[wd] = watchedDir{dir, recursive}
+	w.wds[dir] = wd
+	if !recursive {
+		return nil
+	}
+	infos, err := readDirNames(dir)
+	if err != nil {
+		return nil // removed while adding, will be reported as a change
+	}
+	for _, nm := range infos {
+		if err := w.addLocked(filepath.Join(dir, nm), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, fi := range fis {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (w *watcher) close() error {
+	close(w.stop)
+	<-w.done
+	return unix.Close(w.fd)
+}
+
+func (w *watcher) read() {
+	defer close(w.done)
+	buf := make([]byte, 64*1024)
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		// poll with a timeout so that close is noticed
+		if n, err := unix.Poll(fds, 100); err != nil && err != unix.EINTR {
+			return
+		} else if n <= 0 {
+			continue
+		}
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			w.handle(ev, name)
+		}
+	}
+}
+
+func (w *watcher) handle(ev *unix.InotifyEvent, name []byte) {
+	w.mu.Lock()
+	dir, ok := w.dirs[int(ev.Wd)]
+	if ev.Mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, int(ev.Wd))
+		if ok && w.wds[dir.path] == int(ev.Wd) {
+			delete(w.wds, dir.path)
+		}
+	}
+	isDir := ev.Mask&unix.IN_ISDIR != 0
+	path := dir.path
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i] // the name is padded with zeros
+	}
+	if len(name) > 0 {
+		path = filepath.Join(dir.path, string(name))
+	}
+	if ok && isDir && dir.recursive && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		w.addLocked(path, true)
+	}
+	w.mu.Unlock()
+	if ok && ev.Mask&unix.IN_IGNORED == 0 {
+		select {
+		case w.changes <- change{path, isDir}:
+		case <-w.stop:
+		}
+	}
+}
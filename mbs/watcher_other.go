@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package mbs
+
+import "errors"
+
+type watcher struct {
+	changes chan change
+}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("watching for changes is only supported on linux")
+}
+
+func (w *watcher) add(dir string, recursive bool) error { return nil }
+func (w *watcher) close() error                         { return nil }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vron/mbs/mbs"
+)
+
+// progress renders build events, on a terminal as a live view of what each
+// worker slot is doing, otherwise as plain lines.
+type progress struct {
+	mu  sync.Mutex
+	out io.Writer
+	tty bool
+
+	total, done, failed int
+	running             map[int]*running // by worker slot
+	drawn               int              // number of lines in the live view
+	stop                chan struct{}
+	closed              bool
+}
+
+type running struct {
+	name   string
+	start  time.Time
+	output bytes.Buffer
+}
+
+func newProgress(out *os.File) *progress {
+	tty := false
+	if fi, err := out.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		tty = os.Getenv("TERM") != "dumb"
+	}
+	return startProgress(out, tty)
+}
+
+// startProgress renders to out, as a live view if tty.
+func startProgress(out io.Writer, tty bool) *progress {
+	p := &progress{
+		out:     out,
+		tty:     tty,
+		running: map[int]*running{},
+		stop:    make(chan struct{}),
+	}
+	if p.tty {
+		go p.tick()
+	}
+	return p
+}
+
+// tick redraws the live view so elapsed times are updated.
+func (p *progress) tick() {
+	t := time.NewTicker(200 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.mu.Lock()
+			if !p.closed { // the tick may race with close
+				p.redraw(nil)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// close stops updating and leaves the final state on the terminal.
+func (p *progress) close() {
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.tty {
+		p.clear()
+		fmt.Fprintf(p.out, "%d of %d targets done, %d failed\n", p.done, p.total, p.failed)
+		p.drawn = 0
+	}
+}
+
+func (p *progress) event(e mbs.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return // targets stopped after a failure may report late
+	}
+	name := e.Target
+	if dir := relPath(filepath.Dir(e.Makefile)); dir != "." {
+		name = dir + ":" + e.Target
+	}
+
+	log := []string{}
+	switch e.Type {
+	case mbs.EventDirty:
+		p.total++
+	case mbs.EventStarted:
+		p.running[e.Slot] = &running{name: name, start: e.Time}
+		if !p.tty {
+			log = append(log, fmt.Sprintf("[%d/%d] %s started", p.done, p.total, name))
+		}
+	case mbs.EventOutput:
+		if r := p.running[e.Slot]; r != nil {
+			r.output.WriteString(e.Data)
+		}
+	case mbs.EventFinished:
+		r := p.running[e.Slot]
+		delete(p.running, e.Slot)
+		p.done++
+		if e.Err == "" {
+			log = append(log, fmt.Sprintf("[%d/%d] %s done in %v", p.done, p.total, name, e.Duration.Round(time.Millisecond)))
+			break
+		}
+		p.failed++
+		log = append(log, fmt.Sprintf("[%d/%d] %s failed: %s", p.done, p.total, name, e.Err))
+		if r != nil && r.output.Len() > 0 {
+			log = append(log, strings.TrimRight(r.output.String(), "\n"))
+		}
+	}
+	p.redraw(log)
+}
+
+// redraw prints the log lines above the live view and updates the view.
+func (p *progress) redraw(log []string) {
+	if !p.tty {
+		for _, l := range log {
+			fmt.Fprintln(p.out, l)
+		}
+		return
+	}
+	p.clear()
+	buf := &bytes.Buffer{}
+	for _, l := range log {
+		buf.WriteString(l + "\n")
+	}
+	slots := []int{}
+	for s := range p.running {
+		slots = append(slots, s)
+	}
+	sort.Ints(slots)
+	for _, s := range slots {
+		r := p.running[s]
+		fmt.Fprintf(buf, "  %d: %s %v\n", s, r.name, time.Since(r.start).Round(100*time.Millisecond))
+	}
+	fmt.Fprintf(buf, "%d of %d targets done, %d running, %d failed\n", p.done, p.total, len(slots), p.failed)
+	p.drawn = len(slots) + 1
+	p.out.Write(buf.Bytes())
+}
+
+// clear erases the live view.
+func (p *progress) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.drawn)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vron/mbs/mbs"
+)
+
+// progressEvents are those of a build of two targets of which the second,
+// in another directory, fails.
+func progressEvents(t *testing.T) []mbs.Event {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(wd, "Makefile.mbs")
+	b := filepath.Join(wd, "sub", "Makefile.mbs")
+	return []mbs.Event{
+		{Type: mbs.EventDirty, Target: "a", Makefile: a},
+		{Type: mbs.EventDirty, Target: "b", Makefile: b},
+		{Type: mbs.EventStarted, Target: "a", Makefile: a, Slot: 1, Time: time.Now()},
+		{Type: mbs.EventStarted, Target: "b", Makefile: b, Slot: 2, Time: time.Now()},
+		{Type: mbs.EventOutput, Target: "b", Makefile: b, Slot: 2, Data: "boom\n"},
+		{Type: mbs.EventFinished, Target: "a", Makefile: a, Slot: 1, Duration: time.Second},
+		{Type: mbs.EventFinished, Target: "b", Makefile: b, Slot: 2, Duration: time.Second, Err: "exit status 1"},
+	}
+}
+
+func TestProgressLines(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	p := startProgress(buf, false)
+	for _, e := range progressEvents(t) {
+		p.event(e)
+	}
+	p.close()
+	p.event(mbs.Event{Type: mbs.EventStarted, Target: "late"})
+
+	exp := `[0/2] a started
+[0/2] sub:b started
+[1/2] a done in 1s
+[2/2] sub:b failed: exit status 1
+boom
+`
+	if buf.String() != exp {
+		t.Errorf("expected %q, got %q", exp, buf.String())
+	}
+}
+
+func TestProgressTerminal(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	p := startProgress(buf, true)
+	events := progressEvents(t)
+	for _, e := range events[:4] {
+		p.event(e)
+	}
+	// the live view shows what each slot runs
+	view := buf.String()
+	if !strings.Contains(view, "  1: a ") || !strings.Contains(view, "  2: sub:b ") || !strings.HasSuffix(view, "0 of 2 targets done, 2 running, 0 failed\n") {
+		t.Errorf("expected the running targets, got %q", view)
+	}
+	for _, e := range events[4:] {
+		p.event(e)
+	}
+	p.close()
+
+	out := buf.String()[len(view):]
+	for _, s := range []string{"\x1b[3A\x1b[J[1/2] a done in 1s\n", "[2/2] sub:b failed: exit status 1\nboom\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected the view replaced by %q, got %q", s, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\x1b[1A\x1b[J2 of 2 targets done, 1 failed\n") {
+		t.Errorf("expected the final state, got %q", out)
+	}
+}
@@ -0,0 +1,103 @@
+// Package remote shares stored artifacts between machines over HTTP.
+//
+// The protocol has three kinds of entries, manifests named by the fingerprint
+// of a target, objects named by the sha256 of their content and the records
+// of cache.Shared named by the sha256 of their key, all as lower case hex:
+//
+//	GET  /<kind>/<name>  200 with the content, or 404
+//	HEAD /<kind>/<name>  200 or 404
+//	PUT  /<kind>/<name>  201, the content of objects must match their name
+//
+// where kind is manifests, objects or records.
+package remote
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The kinds of entries.
+const (
+	Manifests = "manifests"
+	Objects   = "objects"
+	Records   = "records"
+)
+
+// timeout is the longest to wait for a server to connect or to start to
+// respond, so that an unreachable server does not stall a build for long.
+var timeout = 10 * time.Second
+
+// Client talks to a server at a base URL.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+// NewClient returns a client for the server at url, e.g.
+// http://cache.example.com:8080/mbs.
+func NewClient(url string) *Client {
+	return &Client{
+		url: strings.TrimSuffix(url, "/"),
+		http: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			ResponseHeaderTimeout: timeout,
+		}},
+	}
+}
+
+// Get copies the named entry to w, ok is false if the server does not have
+// it.
+func (c *Client) Get(kind, name string, w io.Writer) (ok bool, err error) {
+	resp, err := c.http.Get(c.path(kind, name))
+	if err != nil {
+		return false, errors.New("error reading remote cache: " + err.Error())
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return false, errors.New("error reading remote cache: " + err.Error())
+		}
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, errors.New("error reading remote cache: " + resp.Status)
+}
+
+// Put stores what is read from r as the named entry, objects the server
+// allready has are not sent again.
+func (c *Client) Put(kind, name string, r io.Reader) error {
+	if kind == Objects {
+		resp, err := c.http.Head(c.path(kind, name))
+		if err != nil {
+			return errors.New("error writing remote cache: " + err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+	}
+	req, err := http.NewRequest(http.MethodPut, c.path(kind, name), r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("error writing remote cache: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.New("error writing remote cache: " + resp.Status)
+	}
+	return nil
+}
+
+func (c *Client) path(kind, name string) string {
+	return c.url + "/" + kind + "/" + name
+}
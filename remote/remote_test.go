@@ -0,0 +1,162 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vron/mbs/artifact"
+	"github.com/vron/mbs/cache"
+)
+
+func TestShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewServer(filepath.Join(dir, "server"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	// two machines, sharing through the server
+	stores := []*artifact.Store{}
+	for _, n := range []string{"a", "b"} {
+		st, err := artifact.Open(filepath.Join(dir, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Remote = NewClient(srv.URL + "/")
+		stores = append(stores, st)
+	}
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, 0755)
+	if err := ioutil.WriteFile(filepath.Join(src, "out"), []byte("built"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores[0].Put("abcd", src, []string{"out"}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if ok, err := stores[1].Restore("abcd", dst); !ok || err != nil {
+		t.Fatal("expected restored from the server", ok, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "out")); string(data) != "built" {
+		t.Error("bad content restored", string(data))
+	}
+	if ok, err := stores[1].Restore("abce", dst); ok || err != nil {
+		t.Error("expected nothing restored", ok, err)
+	}
+
+	// and the records of caches
+	ca := cache.NewShared(cache.NewMemory(), "p", NewClient(srv.URL))
+	defer ca.Close()
+	cb := cache.NewShared(cache.NewMemory(), "p", NewClient(srv.URL))
+	defer cb.Close()
+	value := bytes.Repeat([]byte{1}, cache.ValueSize)
+	batch := ca.Begin()
+	batch.StageShared("src/*.go", value)
+	batch.Commit()
+	if !bytes.Equal(cb.Begin().GetShared("src/*.go"), value) || ca.Err() != nil || cb.Err() != nil {
+		t.Error("expected the record from the server", ca.Err(), cb.Err())
+	}
+
+	// kept locally, so found without the server
+	srv.Close()
+	if ok, err := stores[1].Restore("abcd", dst); !ok || err != nil {
+		t.Error("expected restored locally", ok, err)
+	}
+	if _, err := stores[1].Restore("abce", dst); err == nil {
+		t.Error("expected an error without the server")
+	}
+}
+
+func TestServerRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewServer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	c := NewClient(srv.URL)
+
+	if err := c.Put(Objects, strings.Repeat("ab", 32), strings.NewReader("data")); err == nil {
+		t.Error("expected an object not matching its name to be rejected")
+	}
+	for _, p := range []string{"/manifests/../x", "/manifests/AB", "/objects/abcd", "/records/abcd", "/other/abcd"} {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+p, bytes.NewReader(nil))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Error("expected", p, "to be rejected, got", resp.Status)
+		}
+	}
+}
+
+func TestBadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	obj := fmt.Sprintf("%x", sha256.Sum256([]byte("evil")))
+	var manifest string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + Manifests + "/abcd":
+			io.WriteString(w, manifest)
+		case "/" + Objects + "/" + obj:
+			io.WriteString(w, "evil")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	st, err := artifact.Open(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Remote = NewClient(srv.URL)
+
+	root := filepath.Join(dir, "a", "root")
+	bad := []struct{ path, object string }{
+		{"../../evil", obj},
+		{"x/../../../evil", obj},
+		{filepath.ToSlash(filepath.Join(dir, "evil")), obj},
+		{"/evil", obj},
+		{"evil", "../../../evil"},
+		{"evil", "ab"},
+	}
+	for _, b := range bad {
+		manifest = fmt.Sprintf(`{"files":[{"path":%q,"mode":420,"object":%q}]}`, b.path, b.object)
+		if ok, err := st.Restore("abcd", root); ok || err == nil {
+			t.Error("expected", b, "to be rejected", ok, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*", "*evil*")); len(files) > 0 {
+		t.Error("expected nothing written outside the root, got", files)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "evil")); len(files) > 0 {
+		t.Error("expected nothing written outside the root, got", files)
+	}
+}
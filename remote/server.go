@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxEntry is the largest entry a server accepts.
+const maxEntry = 1 << 30
+
+// Server serves the entries stored in a directory, in the same layout as an
+// artifact.Store so that a local store may be served as is.
+type Server struct {
+	dir string
+}
+
+// NewServer returns a server of the entries in dir, creating it if needed.
+func NewServer(dir string) (*Server, error) {
+	for _, k := range []string{Manifests, Objects, Records} {
+		if err := os.MkdirAll(filepath.Join(dir, k), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Server{dir: dir}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || (parts[0] != Manifests && parts[0] != Objects && parts[0] != Records) || !validName(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	kind, name := parts[0], parts[1]
+	if kind != Manifests && len(name) != 2*sha256.Size {
+		http.NotFound(w, r)
+		return
+	}
+	path := s.path(kind, name)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		http.ServeFile(w, r, path)
+	case http.MethodPut:
+		if err := s.put(kind, name, path, http.MaxBytesReader(w, r.Body, maxEntry)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// put writes the entry so that it is never seen partially written, checking
+// that the content of an object matches its name.
+func (s *Server) put(kind, name, path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if kind == Objects && hex.EncodeToString(h.Sum(nil)) != name {
+		return errBadObject
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+var errBadObject = errors.New("content does not match the object name")
+
+func (s *Server) path(kind, name string) string {
+	if kind != Manifests {
+		return filepath.Join(s.dir, kind, name[:2], name)
+	}
+	return filepath.Join(s.dir, kind, name)
+}
+
+// validName reports if name is lower case hex, so that it can not be used to
+// reach outside of the directory.
+func validName(name string) bool {
+	if len(name) < 2 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package stat
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// ignoreFiles are the files, in any directory, listing files to ignore in the
+// format of .gitignore.
+var ignoreFiles = []string{".gitignore", ".mbsignore"}
+
+// excluded reports if file, or a directory it is in, matches one of the globs
+// relative to root.
+func excluded(root, file string, exclude []string) bool {
+	for _, e := range exclude {
+		pattern := filepath.Join(root, e)
+		for p := file; strings.HasPrefix(p, root) && p != root; p = filepath.Dir(p) {
+			if ok, _ := doublestar.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// top returns the directory from which ignore files apply to files below
+// root.
+func (s *Stater) top(root string) string {
+	for d := root; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	if s.Root != "" && within(s.Root, root) {
+		return s.Root
+	}
+	return root
+}
+
+// within reports if path is dir or is below it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// An ignorer decides which files below top are ignored, reading each ignore
+// file once.
+type ignorer struct {
+	top   string
+	rules map[string][]rule   // of the ignore files in each directory
+	dirs  map[string]dirState // of the directories seen
+
+	// the last path checked, as patterns walked together check each path in
+	// turn
+	last        string
+	lastIgnored bool
+}
+
+// dirState is what an ignorer knows about a directory.
+type dirState struct {
+	inside  bool // top or below it
+	ignored bool
+	ruled   []string // the directories with rules from top down to it
+}
+
+// rule is a line of an ignore file.
+type rule struct {
+	pattern  string
+	negate   bool // re-includes what an earlier rule ignored
+	dirOnly  bool // only matches directories
+	anchored bool // matches paths relative to the directory of the file, not names
+}
+
+func newIgnorer(top string) *ignorer {
+	return &ignorer{top: top, rules: map[string][]rule{}, dirs: map[string]dirState{}}
+}
+
+// ignored reports if path is ignored, which it is if a directory it is in
+// is.
+func (ig *ignorer) ignored(path string, isDir bool) bool {
+	if path != ig.last {
+		ig.last, ig.lastIgnored = path, ig.check(path, isDir)
+	}
+	return ig.lastIgnored
+}
+
+func (ig *ignorer) check(path string, isDir bool) bool {
+	if path == ig.top {
+		return false
+	}
+	d := ig.dir(filepath.Dir(path))
+	if !d.inside {
+		return false
+	}
+	if d.ignored || filepath.Base(path) == ".git" {
+		return true
+	}
+	return len(d.ruled) > 0 && ig.match(path, isDir, d.ruled)
+}
+
+// dir returns the state of dir, so that checking the files in it does not
+// repeat the work for each.
+func (ig *ignorer) dir(dir string) dirState {
+	d, ok := ig.dirs[dir]
+	if ok {
+		return d
+	}
+	d.inside = within(ig.top, dir)
+	if d.inside {
+		d.ignored = ig.check(dir, true)
+		if dir != ig.top {
+			d.ruled = ig.dir(filepath.Dir(dir)).ruled
+		}
+		if len(ig.load(dir)) > 0 {
+			d.ruled = append(d.ruled[:len(d.ruled):len(d.ruled)], dir)
+		}
+	}
+	ig.dirs[dir] = d
+	return d
+}
+
+// match applies the rules of the directories ruled, those from top down to
+// that of path with rules, the last rule matching decides.
+func (ig *ignorer) match(path string, isDir bool, ruled []string) bool {
+	ignored := false
+	for _, dir := range ruled {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, r := range ig.load(dir) {
+			if r.matches(rel, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (r rule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	name := rel
+	if !r.anchored {
+		name = rel[strings.LastIndex(rel, "/")+1:]
+	}
+	ok, _ := doublestar.Match(r.pattern, name)
+	return ok
+}
+
+// load returns the rules of the ignore files in dir.
+func (ig *ignorer) load(dir string) []rule {
+	rules, ok := ig.rules[dir]
+	if ok {
+		return rules
+	}
+	for _, name := range ignoreFiles {
+		rules = append(rules, readRules(filepath.Join(dir, name))...)
+	}
+	ig.rules[dir] = rules
+	return rules
+}
+
+// readRules reads the ignore file at path, which may not exist.
+func readRules(path string) []rule {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	rules := []rule{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		r := rule{}
+		if line[0] == '!' {
+			r.negate, line = true, line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:] // escaped # or !
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimSuffix(line, "/")
+		}
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		if r.pattern != "" {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
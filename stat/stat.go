@@ -3,50 +3,160 @@ package stat
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
-
-	"github.com/bmatcuk/doublestar"
 )
 
+// Options configure how files are hashed.
+type Options struct {
+	// Content makes the hash depend on the contents of files rather than on
+	// their modification times.
+	Content bool
+	// Lstat hashes symbolic links themselves rather than the files they
+	// point to, so that a link pointing nowhere is not an error.
+	Lstat bool
+	// Root is the directory of the project, see Stat.
+	Root string
+}
+
+// Filter selects which of the files matched by a glob are hashed.
+type Filter struct {
+	// Exclude holds globs, relative to the root given to Stat, of files to
+	// leave out, a matched directory leaves out everything in it.
+	Exclude []string
+	// NoIgnore keeps the files ignored by .gitignore and .mbsignore files.
+	NoIgnore bool
+}
+
+// String returns the filter as written after a glob in a makefile, "" for
+// the zero Filter.
+func (f Filter) String() string {
+	s := ""
+	if f.NoIgnore {
+		s += " +"
+	}
+	for _, e := range f.Exclude {
+		s += " !" + e
+	}
+	return s
+}
+
 type Stater struct {
-	checkContent bool
+	Options
+	files int
 }
 
-func New(checkContent bool) *Stater {
+func New(o Options) *Stater {
 	s := &Stater{
-		checkContent: checkContent,
+		Options: o,
 	}
 	return s
 }
 
 // Stat creates a hash of all the files given by expr (using root), either
-// by using contents of files or only the mod-time.
-// TODO: include a ref to cache so we can write for each individual file
-func (s *Stater) Stat(root string, expr string) (hash []byte, err error) {
-	if !filepath.IsAbs(expr) {
-		expr = filepath.Join(root, expr)
-	}
-
-	files, err := doublestar.Glob(expr)
+// by using contents of files or only the mod-time, together with their paths
+// relative to root. n is the number of files hashed.
+//
+// Files selected by f are left out, as are, unless f.NoIgnore, .git
+// directories and files ignored by the .gitignore and .mbsignore files from
+// the top of the git work tree of root, or else from the Root of the
+// project, down to them.
+//
+// Use StatAll to hash several globs.
+func (s *Stater) Stat(root string, expr string, f Filter) (hash []byte, n int, err error) {
+	res, err := s.StatAll([]Glob{{Root: root, Pattern: expr, Filter: f}})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	return res[0].Hash, res[0].N, nil
+}
+
+// hash returns the hash of the files matched by a glob relative to root.
+// infos holds what Lstat returned for files while walking, digests the
+// digests of the contents of files allready read.
+// TODO: include a ref to cache so we can write for each individual file
+func (s *Stater) hash(root string, files []string, infos map[string]os.FileInfo, digests map[string][]byte) ([]byte, error) {
 	h := sha256.New224()
 
 	// We must be carefull with the ordering when hashing
 	sort.Strings(files)
-	for _, f := range files {
-		// TODO: Stat or LStat - should also be configurable?
-		fi, err := os.Stat(f) // Todo - really should be merged with the recursive directory handling
-		if err != nil {
+	for _, file := range files {
+		fi := infos[file]
+		if fi == nil || (!s.Lstat && fi.Mode()&os.ModeSymlink != 0) {
+			var err error
+			if fi, err = s.stat(file); err != nil {
+				return nil, err
+			}
+		}
+		if err := writePath(h, root, file); err != nil {
 			return nil, err
 		}
-		binary.Write(h, binary.BigEndian, fi.Name())
+		if s.Content {
+			if err := hashContent(h, file, fi, digests); err != nil {
+				return nil, err
+			}
+			continue
+		}
 		binary.Write(h, binary.BigEndian, fi.Size())
 		binary.Write(h, binary.BigEndian, fi.ModTime().UnixNano())
 	}
-
 	return h.Sum(nil), nil
 }
+
+func (s *Stater) stat(f string) (os.FileInfo, error) {
+	if s.Lstat {
+		return os.Lstat(f)
+	}
+	return os.Stat(f)
+}
+
+// writePath writes the path of f relative to root to h, so that moving a file
+// changes the hash while the same files in another checkout do not.
+func writePath(h io.Writer, root, f string) error {
+	rel, err := filepath.Rel(root, f)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(h, filepath.ToSlash(rel)+"\x00")
+	return err
+}
+
+// hashContent writes a digest of the contents of f to h, or where it points
+// if it is a symbolic link that was not followed.
+func hashContent(h io.Writer, f string, fi os.FileInfo, digests map[string][]byte) error {
+	if fi.IsDir() {
+		return nil // the size of a directory depends on the file system
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		dst, err := os.Readlink(f)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(h, "-> "+dst)
+		return err
+	}
+	binary.Write(h, binary.BigEndian, fi.Size())
+	d, ok := digests[f]
+	if !ok {
+		r, err := os.Open(f)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		dh := sha256.New()
+		if _, err = io.Copy(dh, r); err != nil {
+			return err
+		}
+		d = dh.Sum(nil)
+		digests[f] = d
+	}
+	_, err := h.Write(d)
+	return err
+}
+
+// Files returns the number of files stated so far.
+func (s *Stater) Files() int {
+	return s.files
+}
@@ -1 +1,148 @@
 package stat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(path, data string, mtime time.Time) {
+		p := filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(p), 0777)
+		if err := ioutil.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+	hash := func(root string) []byte {
+		h, _, err := New(Options{Content: true}).Stat(filepath.Join(dir, root), "**/*.txt", Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write("a/x/1.txt", "one", time.Unix(1, 0))
+	write("b/x/1.txt", "one", time.Unix(2, 0))
+	if !bytes.Equal(hash("a"), hash("b")) {
+		t.Error("expected the same files in another directory to have the same hash")
+	}
+	write("b/x/1.txt", "two", time.Unix(2, 0))
+	if bytes.Equal(hash("a"), hash("b")) {
+		t.Error("expected changed contents to change the hash")
+	}
+	write("b/x/1.txt", "one", time.Unix(2, 0))
+	write("b/x/2.txt", "", time.Unix(2, 0))
+	if bytes.Equal(hash("a"), hash("b")) {
+		t.Error("expected an added file to change the hash")
+	}
+}
+
+func TestPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := New(Options{})
+	h, n, err := s.Stat(dir, "**/*.py", Filter{})
+	if err != nil || n != 0 {
+		t.Fatal("expected no matches", n, err)
+	}
+
+	mtime := time.Unix(1, 0)
+	os.MkdirAll(filepath.Join(dir, "a"), 0777)
+	os.MkdirAll(filepath.Join(dir, "b"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "a", "x.py"), []byte("x"), 0666)
+	os.Chtimes(filepath.Join(dir, "a", "x.py"), mtime, mtime)
+	h, n, err = s.Stat(dir, "**/*.py", Filter{})
+	if err != nil || n != 1 {
+		t.Fatal("expected one match", n, err)
+	}
+	if err := os.Rename(filepath.Join(dir, "a", "x.py"), filepath.Join(dir, "b", "x.py")); err != nil {
+		t.Fatal(err)
+	}
+	h2, _, err := s.Stat(dir, "**/*.py", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(h, h2) {
+		t.Error("expected moving a file to change the hash")
+	}
+}
+
+func TestLstat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "link")); err != nil {
+		t.Skip("no symbolic links:", err)
+	}
+	if _, _, err := New(Options{}).Stat(dir, "*", Filter{}); err == nil {
+		t.Error("expected a link pointing nowhere to be an error")
+	}
+	for _, content := range []bool{false, true} {
+		if _, n, err := New(Options{Lstat: true, Content: content}).Stat(dir, "*", Filter{}); err != nil || n != 1 {
+			t.Error("expected the link itself to be hashed", n, err)
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for f, data := range map[string]string{
+		".git/config":               "",
+		".gitignore":                "node_modules/\n*.pyc\n!keep.pyc\n/top.py\n",
+		"src/.mbsignore":            "gen\n",
+		"src/a.py":                  "",
+		"src/a.pyc":                 "",
+		"src/keep.pyc":              "",
+		"src/top.py":                "",
+		"top.py":                    "",
+		"src/gen/b.py":              "",
+		"src/node_modules/x/c.py":   "",
+		"src/__pycache__/d.py":      "",
+		"src/lib/__pycache__/e.pyc": "",
+	} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		os.MkdirAll(filepath.Dir(p), 0777)
+		if err := ioutil.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(expr string, f Filter) int {
+		_, n, err := New(Options{}).Stat(filepath.Join(dir, "src"), expr, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// a.py, keep.pyc, top.py and __pycache__/d.py
+	if n := count("**/*.py*", Filter{}); n != 4 {
+		t.Error("expected ignored files to be left out, got", n)
+	}
+	if n := count("**/*.py*", Filter{Exclude: []string{"**/__pycache__"}}); n != 3 {
+		t.Error("expected excluded files to be left out, got", n)
+	}
+	if n := count("**/*.py*", Filter{NoIgnore: true}); n != 8 {
+		t.Error("expected nothing to be ignored, got", n)
+	}
+	if n := count("../**/config", Filter{}); n != 0 {
+		t.Error("expected .git to be ignored, got", n)
+	}
+}
@@ -0,0 +1,283 @@
+package stat
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// A Glob is a pattern for StatAll.
+type Glob struct {
+	Root    string // the pattern is relative to Root unless absolute
+	Pattern string
+	Filter  Filter
+}
+
+// A Result is what StatAll found for a Glob.
+type Result struct {
+	Hash  []byte
+	N     int      // the number of files hashed
+	Files []string // the files hashed, sorted
+}
+
+// pattern is a Glob prepared for walking.
+type pattern struct {
+	Glob
+	base  string      // the directory below which all matches are
+	depth int         // of matches below base, -1 if any depth
+	match []glob.Glob // any of which matches, nil for a pattern without meta characters
+	ig    *ignorer    // nil if Filter.NoIgnore
+	files []string
+}
+
+// StatAll does what Stat does for each of the globs, walking each directory
+// once for all of them. Directories that no glob can match anything in, or
+// that all globs ignore, are not walked. Symbolic links to directories are
+// followed like by doublestar, except to a directory they are in.
+func (s *Stater) StatAll(globs []Glob) ([]Result, error) {
+	ps := make([]*pattern, len(globs))
+	igs := map[string]*ignorer{} // by top
+	for i, g := range globs {
+		p, err := newPattern(g)
+		if err != nil {
+			return nil, err
+		}
+		if !g.Filter.NoIgnore {
+			top := s.top(g.Root)
+			if igs[top] == nil {
+				igs[top] = newIgnorer(top)
+			}
+			p.ig = igs[top]
+		}
+		ps[i] = p
+	}
+
+	// patterns without meta characters name a single file, the others are
+	// grouped by the outermost base they are in.
+	walks := map[string][]*pattern{}
+	bases := []string{}
+	infos := map[string]os.FileInfo{} // of the files found, by path
+	for _, p := range ps {
+		if p.match == nil {
+			if fi, err := os.Lstat(p.base); err == nil {
+				infos[p.base] = fi
+				p.visit(p.base, fi.IsDir())
+			}
+			continue
+		}
+		bases = append(bases, p.base)
+	}
+	sort.Strings(bases)
+	roots := []string{}
+	for _, b := range bases {
+		if len(roots) == 0 || !inside(roots[len(roots)-1], b) {
+			roots = append(roots, b)
+		}
+	}
+	for _, p := range ps {
+		if p.match == nil {
+			continue
+		}
+		i := sort.SearchStrings(roots, p.base)
+		if i == len(roots) || roots[i] != p.base {
+			i-- // in the root before it
+		}
+		walks[roots[i]] = append(walks[roots[i]], p)
+	}
+
+	for _, root := range roots {
+		if err := walk(root, walks[root], infos); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]Result, len(ps))
+	digests := map[string][]byte{} // of the contents of files, by path
+	for i, p := range ps {
+		hash, err := s.hash(p.Root, p.files, infos, digests)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = Result{Hash: hash, N: len(p.files), Files: p.files}
+		s.files += len(p.files)
+	}
+	return res, nil
+}
+
+// walk visits everything below root that any of ps may match, adding what
+// was found to infos. Symbolic links to directories are followed, and taken
+// as the directories, unless they link to a directory they are in.
+func walk(root string, ps []*pattern, infos map[string]os.FileInfo) error {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // no base
+		}
+		return err
+	}
+	return walkPath(root, fi, ps, infos, nil)
+}
+
+// walkPath visits path, of which fi is the Lstat, and what is below it. dirs
+// are the directories path is in.
+func walkPath(path string, fi os.FileInfo, ps []*pattern, infos map[string]os.FileInfo, dirs []os.FileInfo) error {
+	infos[path] = fi
+	dir := fi
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Stat(path); err == nil && target.IsDir() {
+			dir = target
+		}
+	}
+	descend := false
+	for _, p := range ps {
+		if !inside(p.base, path) {
+			if inside(path, p.base) {
+				descend = true // on the way to its base
+			}
+			continue
+		}
+		if p.visit(path, dir.IsDir()) {
+			descend = descend || p.below(path)
+		}
+	}
+	if !dir.IsDir() || !descend {
+		return nil
+	}
+	for _, d := range dirs {
+		if os.SameFile(d, dir) {
+			return nil // a link to a directory it is in
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // removed while walking
+		}
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	dirs = append(dirs, dir)
+	for _, name := range names {
+		child := filepath.Join(path, name)
+		cfi, err := os.Lstat(child)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed while walking
+			}
+			return err
+		}
+		if err := walkPath(child, cfi, ps, infos, dirs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newPattern(g Glob) (*pattern, error) {
+	expr := g.Pattern
+	if !filepath.IsAbs(expr) {
+		expr = filepath.Join(g.Root, expr)
+	}
+	p := &pattern{Glob: g, base: expr, files: []string{}}
+	parts := strings.Split(filepath.ToSlash(expr), "/")
+	for i, part := range parts {
+		if !strings.ContainsAny(part, `*?[{\`) {
+			continue
+		}
+		p.base = filepath.Clean(filepath.FromSlash(strings.Join(parts[:i], "/") + "/"))
+		p.depth = len(parts) - i
+		for _, r := range parts[i:] {
+			if r == "**" {
+				p.depth = -1
+			}
+		}
+		for _, v := range compile(parts) {
+			m, err := glob.Compile(v, '/')
+			if err != nil {
+				return nil, err
+			}
+			p.match = append(p.match, m)
+		}
+		break
+	}
+	return p, nil
+}
+
+// compile returns the patterns for package glob, where ** matches at least
+// one directory, that together match what the parts of a pattern match when
+// a ** that is not last matches any number of directories, including none,
+// like in doublestar. They are not joined by {,} since package glob does not
+// handle ** within those.
+func compile(parts []string) []string {
+	vs := []string{""}
+	for i, part := range parts {
+		last := i == len(parts)-1
+		next := []string{}
+		for _, v := range vs {
+			switch {
+			case part == "**" && !last:
+				next = append(next, v, v+"**/")
+			case last:
+				next = append(next, v+part)
+			default:
+				next = append(next, v+part+"/")
+			}
+		}
+		vs = next
+	}
+	return vs
+}
+
+// visit adds path if p matches it, reporting false if path is left out by
+// the filter of p so that nothing below it should be visited.
+func (p *pattern) visit(path string, isDir bool) bool {
+	if excluded(p.Root, path, p.Filter.Exclude) || (p.ig != nil && p.ig.ignored(path, isDir)) {
+		return false
+	}
+	if p.match == nil {
+		p.files = append(p.files, path)
+		return true
+	}
+	slashed := filepath.ToSlash(path)
+	for _, m := range p.match {
+		if m.Match(slashed) {
+			p.files = append(p.files, path)
+			break
+		}
+	}
+	return true
+}
+
+// below reports if p may match anything below the directory dir.
+func (p *pattern) below(dir string) bool {
+	if p.match == nil {
+		return false
+	}
+	if p.depth < 0 {
+		return true
+	}
+	rel := strings.TrimPrefix(dir[len(p.base):], string(filepath.Separator))
+	d := 0
+	if rel != "" {
+		d = strings.Count(rel, string(filepath.Separator)) + 1
+	}
+	return d < p.depth
+}
+
+// inside reports if the clean path is dir or below it, like within but
+// cheaper.
+func inside(dir, path string) bool {
+	if !strings.HasPrefix(path, dir) {
+		return false
+	}
+	return len(path) == len(dir) || path[len(dir)] == filepath.Separator || strings.HasSuffix(dir, string(filepath.Separator))
+}
@@ -0,0 +1,226 @@
+package stat
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+func TestStatAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"a.py", "lib/b.py", "lib/c/d.py", "lib/c/e.txt", "doc/f.txt"} {
+		p := filepath.Join(dir, f)
+		os.MkdirAll(filepath.Dir(p), 0777)
+		if err := ioutil.WriteFile(p, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	patterns := []string{
+		"**/*.py", "lib/**", "lib/**/*.py", "**/c/*", "*/*.txt", "lib", "lib/c/d.py",
+		"missing", "missing/**", "l?b/[bc]*", "{doc,lib}/*",
+	}
+	globs := []Glob{}
+	for _, p := range patterns {
+		globs = append(globs, Glob{Root: dir, Pattern: p, Filter: Filter{NoIgnore: true}})
+	}
+	s := New(Options{})
+	res, err := s.StatAll(globs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range patterns {
+		matches, err := doublestar.Glob(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[i].N != len(matches) {
+			t.Error("expected", p, "to match", matches, "got", res[i].N)
+		}
+		h, _, err := s.Stat(dir, p, Filter{NoIgnore: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(h, res[i].Hash) {
+			t.Error("expected the same hash from Stat and StatAll for", p)
+		}
+	}
+
+	// links to directories are followed, but not to one they are in
+	os.MkdirAll(filepath.Join(dir, "src"), 0777)
+	os.MkdirAll(filepath.Join(dir, "real"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "real/x.py"), nil, 0666)
+	if err := os.Symlink("../real", filepath.Join(dir, "src/lib")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(dir, "real/self")); err != nil {
+		t.Fatal(err)
+	}
+	for p, n := range map[string]int{"src/**/*.py": 1, "src/lib/*.py": 1, "src/*/x.py": 1, "real/**/*.py": 1} {
+		res, err := s.StatAll([]Glob{{Root: dir, Pattern: p, Filter: Filter{NoIgnore: true}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res[0].N != n {
+			t.Error("expected", p, "to match", n, "got", res[0].Files)
+		}
+	}
+}
+
+func TestStatAllGlobEach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{
+		".gitignore", "a.py", "a.txt", "lib/b.py", "lib/c/d.py", "lib/c/e.txt", "lib/gen/g.py",
+		"build/h.py", "doc/f.md", "real/x.py", "real/y/z.py",
+	} {
+		p := filepath.Join(dir, f)
+		os.MkdirAll(filepath.Dir(p), 0777)
+		if err := ioutil.WriteFile(p, []byte(f), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.txt\nbuild/\n"), 0666)
+	// doublestar loops on links to a directory they are in, so there are none
+	if err := os.Symlink("../real", filepath.Join(dir, "lib/real")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real/y", filepath.Join(dir, "y")); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns := []string{
+		"**/*.py", "**", "lib/**", "lib/**/*.py", "**/*.txt", "lib/real/*.py", "*/z.py",
+		"**/y/*", "lib", "a.py", "build/h.py", "{doc,lib}/*", "l?b/[bc]*", "missing/**",
+	}
+	filters := []Filter{
+		{}, {NoIgnore: true}, {Exclude: []string{"lib/gen"}}, {Exclude: []string{"**/*.txt", "lib/real"}},
+		{Exclude: []string{"y"}, NoIgnore: true},
+	}
+	globs := []Glob{}
+	for _, f := range filters {
+		for _, p := range patterns {
+			globs = append(globs, Glob{Root: dir, Pattern: p, Filter: f})
+		}
+	}
+	s := New(Options{Content: true})
+	res, err := s.StatAll(globs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range globs {
+		exp, err := globEach(s, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(res[i].Files, " ") != strings.Join(exp.Files, " ") || !bytes.Equal(res[i].Hash, exp.Hash) {
+			t.Errorf("%s %v: expected %v, got %v", g.Pattern, g.Filter, exp.Files, res[i].Files)
+		}
+	}
+}
+
+// globEach stats g as was done before StatAll, with a doublestar.Glob and the
+// exclusions and ignore files applied to what it matched.
+func globEach(s *Stater, g Glob) (Result, error) {
+	matches, err := doublestar.Glob(filepath.Join(g.Root, g.Pattern))
+	if err != nil {
+		return Result{}, err
+	}
+	var ig *ignorer
+	if !g.Filter.NoIgnore {
+		ig = newIgnorer(s.top(g.Root))
+	}
+	files := []string{}
+	for _, f := range matches {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return Result{}, err
+		}
+		if excluded(g.Root, f, g.Filter.Exclude) || (ig != nil && ig.ignored(f, fi.IsDir())) {
+			continue
+		}
+		files = append(files, f)
+	}
+	hash, err := s.hash(g.Root, files, nil, map[string][]byte{})
+	return Result{Hash: hash, N: len(files), Files: files}, err
+}
+
+// benchPatterns are globs of a build of the tree made by benchTree, some
+// overlapping.
+var benchPatterns = []string{
+	"**/*.go", "src/**/*.go", "src/**", "cmd/*/*/*.go", "docs/**/*.md",
+	"src/d3/**/*.py", "vendor/**", "**/*.py", "README",
+}
+
+// benchTree writes 50 000 files to a new directory, a fifth of them in an
+// ignored node_modules directory.
+func benchTree(b *testing.B) string {
+	dir, err := ioutil.TempDir("", "stat")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("node_modules/\n*.txt\n"), 0666); err != nil {
+		b.Fatal(err)
+	}
+	exts := []string{".go", ".py", ".md", ".txt"}
+	for _, top := range []string{"src", "cmd", "docs", "vendor", "node_modules"} {
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 10; j++ {
+				d := filepath.Join(dir, top, fmt.Sprint("d", i), fmt.Sprint("s", j))
+				if err := os.MkdirAll(d, 0777); err != nil {
+					b.Fatal(err)
+				}
+				for k := 0; k < 100; k++ {
+					f := filepath.Join(d, fmt.Sprint("f", k, exts[k%len(exts)]))
+					if err := ioutil.WriteFile(f, nil, 0666); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+	return dir
+}
+
+func BenchmarkStatAll(b *testing.B) {
+	dir := benchTree(b)
+	defer os.RemoveAll(dir)
+	globs := []Glob{}
+	for _, p := range benchPatterns {
+		globs = append(globs, Glob{Root: dir, Pattern: p})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := New(Options{}).StatAll(globs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGlobEach stats the globs as was done before StatAll, see globEach.
+func BenchmarkGlobEach(b *testing.B) {
+	dir := benchTree(b)
+	defer os.RemoveAll(dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := New(Options{})
+		for _, p := range benchPatterns {
+			if _, err := globEach(s, Glob{Root: dir, Pattern: p}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}